@@ -2,265 +2,6179 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"html"
 	"io"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/mail"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	log "github.com/sirupsen/logrus"
 
 	"gopkg.in/yaml.v2"
 )
 
+// Clock provides the current time and waits for time to pass. Code that
+// depends on the time of day or on elapsed time uses the package clock
+// instead of calling time.Now or time.Sleep directly, so tests can substitute
+// a FakeClock.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// FakeClock is a Clock that only moves when Set, Advance or Sleep is called.
+// Sleep returns immediately after advancing the clock by the duration.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+var clock Clock = realClock{}
+
+// Errors returned by processFeed are wrapped with one of these categories,
+// so callers can tell failures apart with errors.Is.
+var (
+	ErrFetch  = errors.New("fetch error")
+	ErrParse  = errors.New("parse error")
+	ErrNotify = errors.New("notify error")
+)
+
+// FeedResult summarizes one check of a feed.
+type FeedResult struct {
+	URL string
+	// Parsed is the number of items in the feed document, New the number
+	// of them that were new and Notified the number of those whose
+	// notification was sent during the check. With notification workers
+	// running, sends are counted in the feed's statistics as they finish
+	// instead.
+	Parsed   int
+	New      int
+	Notified int
+	Err      error
+	Duration time.Duration
+	// Next is the URL of the next page of a paginated Atom feed (RFC
+	// 5005), or "".
+	Next string
+}
+
+// Category returns "fetch", "parse" or "notify" for a failed check and ""
+// for a successful one.
+func (r FeedResult) Category() string {
+	switch {
+	case r.Err == nil:
+		return ""
+	case errors.Is(r.Err, ErrFetch):
+		return "fetch"
+	case errors.Is(r.Err, ErrParse):
+		return "parse"
+	case errors.Is(r.Err, ErrNotify):
+		return "notify"
+	}
+	return "other"
+}
+
 type Rss struct {
 	XMLName xml.Name `xml:"rss"`
 	Channel Channel  `xml:"channel"`
+	// Base is the xml:base that relative links are resolved against.
+	Base string `xml:"http://www.w3.org/XML/1998/namespace base,attr"`
+}
+
+type Channel struct {
+	Title string `xml:"title"`
+	// Links collects every <link> child, including namespaced ones such as
+	// <atom:link rel="self"/>, which has no text. Use siteLink for the
+	// channel's site URL.
+	Links []string `xml:"link"`
+	Image Image    `xml:"image"`
+	Item  []Item   `xml:"item"`
+	Base  string   `xml:"http://www.w3.org/XML/1998/namespace base,attr"`
+}
+
+// siteLink returns the channel's site URL, the first non-empty <link>.
+func (c Channel) siteLink() string {
+	for _, link := range c.Links {
+		if link = strings.TrimSpace(link); link != "" {
+			return link
+		}
+	}
+	return ""
+}
+
+type Image struct {
+	URL string `xml:"url"`
+}
+
+type Item struct {
+	Title     string `xml:"title"`
+	Link      string `xml:"link"`
+	GUID      string `xml:"guid"`
+	Published string `xml:"pubDate"`
+	// DCDate and Updated are the item's <dc:date> and <atom:updated>,
+	// which feeds with date_fields can use instead of pubDate.
+	DCDate  string `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Updated string `xml:"http://www.w3.org/2005/Atom updated"`
+	// Categories are the item's <category> values.
+	Categories []string `xml:"category"`
+	// Author is the item's <author>, usually an email address, and Creator
+	// its <dc:creator>, usually a name.
+	Author  string `xml:"author"`
+	Creator string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	// Content is the item's HTML <content:encoded>, usually its full text.
+	Content string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	// Description is often only a summary, but is HTML too.
+	Description string `xml:"description"`
+	Media
+	MediaGroup Media `xml:"http://search.yahoo.com/mrss/ group"`
+	// Source names the feed an aggregator took the item from.
+	Source Source `xml:"source"`
+	// Raw is the item's XML, which the feed's match is evaluated against.
+	Raw  string `xml:",innerxml"`
+	Base string `xml:"http://www.w3.org/XML/1998/namespace base,attr"`
+}
+
+// Source is an RSS item's <source>: the title of the original feed, and
+// its URL.
+type Source struct {
+	Name string `xml:",chardata"`
+	URL  string `xml:"url,attr"`
+}
+
+type Atom struct {
+	XMLName xml.Name `xml:"feed"`
+	Title   string   `xml:"title"`
+	Icon    string   `xml:"icon"`
+	Logo    string   `xml:"logo"`
+	Links   []Link   `xml:"link"`
+	Entries []Entry  `xml:"entry"`
+	Base    string   `xml:"http://www.w3.org/XML/1998/namespace base,attr"`
+}
+
+// nextPage returns the link to the page of older entries of a paged or
+// archived feed (RFC 5005), resolved against pageURL, or "".
+func (a Atom) nextPage(pageURL string) string {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+	for _, rel := range []string{"next", "prev-archive", "prev", "previous"} {
+		for _, link := range a.Links {
+			if link.Rel == rel && link.Href != "" {
+				return resolveLink(base, link.Href)
+			}
+		}
+	}
+	return ""
+}
+
+type Entry struct {
+	Title      string     `xml:"title"`
+	Link       Link       `xml:"link"`
+	ID         string     `xml:"id"`
+	Published  string     `xml:"published"`
+	Updated    string     `xml:"updated"`
+	DCDate     string     `xml:"http://purl.org/dc/elements/1.1/ date"`
+	Categories []Category `xml:"category"`
+	Authors    []Person   `xml:"author"`
+	Content    Content    `xml:"content"`
+	Summary    Content    `xml:"summary"`
+	Media
+	MediaGroup Media `xml:"http://search.yahoo.com/mrss/ group"`
+	// Source holds the metadata of the feed an aggregator copied the
+	// entry from.
+	Source AtomSource `xml:"source"`
+	// Raw is the entry's XML, which the feed's match is evaluated against.
+	Raw  string `xml:",innerxml"`
+	Base string `xml:"http://www.w3.org/XML/1998/namespace base,attr"`
+}
+
+// AtomSource is the part of an entry's <source> naming the original feed.
+type AtomSource struct {
+	Title string `xml:"title"`
+}
+
+// dateFieldNames are the values date_fields may list.
+var dateFieldNames = []string{"pubDate", "published", "dc:date", "updated"}
+
+// date returns the first non-empty of the item's date fields, or its
+// pubDate when fields is empty. An RSS item's published is its pubDate.
+func (i Item) date(fields []string) string {
+	return firstDate(fields, i.Published, i.Published, i.DCDate, i.Updated)
+}
+
+// date returns the first non-empty of the entry's date fields, or its
+// published date when fields is empty. An entry's pubDate is its published.
+func (e Entry) date(fields []string) string {
+	return firstDate(fields, e.Published, e.Published, e.DCDate, e.Updated)
+}
+
+// firstDate returns the first non-empty value among the fields, given the
+// values of the dateFieldNames in order, or the first value when fields is
+// empty.
+func firstDate(fields []string, values ...string) string {
+	if len(fields) == 0 {
+		return values[0]
+	}
+	for _, field := range fields {
+		if v := values[slices.Index(dateFieldNames, field)]; strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// author returns the item's author, preferring the name in dc:creator.
+func (i Item) author() string {
+	return strings.TrimSpace(firstNonEmpty(i.Creator, i.Author))
+}
+
+// author returns the name of the entry's first author.
+func (e Entry) author() string {
+	for _, a := range e.Authors {
+		if name := strings.TrimSpace(a.Name); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// html returns the item's full content, falling back to its description.
+func (i Item) html() string {
+	return firstNonEmpty(i.Content, i.Description)
+}
+
+// html returns the entry's content as HTML, falling back to its summary.
+// XHTML content is not supported.
+func (e Entry) html() string {
+	return firstNonEmpty(e.Content.html(), e.Summary.html())
+}
+
+type Link struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Base string `xml:"http://www.w3.org/XML/1998/namespace base,attr"`
+}
+
+type Category struct {
+	Term string `xml:"term,attr"`
+}
+
+// Person is an Atom <author>.
+type Person struct {
+	Name string `xml:"name"`
+}
+
+// Content is an Atom <content> or <summary> element. Type is "text" (the
+// default), "html" or "xhtml".
+type Content struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// html returns the element's body as HTML, or "" for XHTML.
+func (c Content) html() string {
+	switch c.Type {
+	case "", "text":
+		return html.EscapeString(c.Body)
+	case "html":
+		return c.Body
+	}
+	return ""
+}
+
+// JSONFeed is a JSON Feed (https://jsonfeed.org) document.
+type JSONFeed struct {
+	Version     string     `json:"version"`
+	Title       string     `json:"title"`
+	HomePageURL string     `json:"home_page_url"`
+	Icon        string     `json:"icon"`
+	Items       []JSONItem `json:"items"`
+}
+
+type JSONItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	Title         string   `json:"title"`
+	DatePublished string   `json:"date_published"`
+	Image         string   `json:"image"`
+	Tags          []string `json:"tags"`
+	ContentHTML   string   `json:"content_html"`
+	ContentText   string   `json:"content_text"`
+	Summary       string   `json:"summary"`
+	DateModified  string   `json:"date_modified"`
+	// Authors is JSON Feed 1.1's list of authors, Author the single
+	// author of 1.0.
+	Authors []JSONAuthor `json:"authors"`
+	Author  JSONAuthor   `json:"author"`
+}
+
+type JSONAuthor struct {
+	Name string `json:"name"`
+}
+
+// author returns the name of the item's first author.
+func (ji JSONItem) author() string {
+	for _, a := range append(ji.Authors, ji.Author) {
+		if a.Name != "" {
+			return a.Name
+		}
+	}
+	return ""
+}
+
+// toRSS converts a JSON feed to the equivalent RSS document.
+func (jf JSONFeed) toRSS() Rss {
+	rss := Rss{Channel: Channel{
+		Title: jf.Title,
+		Links: []string{jf.HomePageURL},
+		Image: Image{URL: jf.Icon},
+	}}
+	for _, ji := range jf.Items {
+		item := Item{
+			Title:      ji.Title,
+			Link:       ji.URL,
+			GUID:       ji.ID,
+			Published:  ji.DatePublished,
+			Updated:    ji.DateModified,
+			Categories: ji.Tags,
+			Creator:    ji.author(),
+			Content:    ji.ContentHTML,
+			// Both are plain text.
+			Description: html.EscapeString(firstNonEmpty(ji.ContentText, ji.Summary)),
+		}
+		if ji.Image != "" {
+			item.Contents = []MediaContent{{URL: ji.Image, Medium: "image"}}
+		}
+		rss.Channel.Item = append(rss.Channel.Item, item)
+	}
+	return rss
+}
+
+// Media holds the Media RSS (http://search.yahoo.com/mrss/) elements of an
+// item or entry. They may appear directly on the item or inside a
+// <media:group>, as YouTube feeds do.
+type Media struct {
+	Contents   []MediaContent   `xml:"http://search.yahoo.com/mrss/ content"`
+	Thumbnails []MediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+}
+
+type MediaContent struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Medium string `xml:"medium,attr"`
+}
+
+type MediaThumbnail struct {
+	URL string `xml:"url,attr"`
+}
+
+// mediaThumbnail returns the first thumbnail URL found in the given media
+// sets, in order.
+func mediaThumbnail(sets ...Media) string {
+	for _, media := range sets {
+		for _, t := range media.Thumbnails {
+			if t.URL != "" {
+				return t.URL
+			}
+		}
+	}
+	return ""
+}
+
+// mediaImage returns the first media content URL in the given media sets
+// that is an image, so it can be attached to the notification.
+func mediaImage(sets ...Media) string {
+	for _, media := range sets {
+		for _, c := range media.Contents {
+			if c.URL != "" && (c.Medium == "image" || strings.HasPrefix(c.Type, "image/")) {
+				return c.URL
+			}
+		}
+	}
+	return ""
+}
+
+// Notification is a single message published to an ntfy topic.
+type Notification struct {
+	Topic string `json:"topic"`
+	// Token is the feed's credential for Topic. It is left out of the
+	// dead-letter and state files; Feed, the URL of the feed the
+	// notification is for, is kept so the token can be looked up again.
+	Token    string `json:"-"`
+	Feed     string `json:"feed,omitempty"`
+	Title    string `json:"title"`
+	Link     string `json:"link"`
+	Icon     string `json:"icon,omitempty"`
+	Attach   string `json:"attach,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Call     string `json:"call,omitempty"`
+	Tags     string `json:"tags,omitempty"`
+	// Body is Markdown shown between the title and the link.
+	Body       string `json:"body,omitempty"`
+	SingleLine bool   `json:"single_line,omitempty"`
+	// Separator overrides the separator between the parts of the message.
+	Separator string `json:"separator,omitempty"`
+	// LinkFirst puts the link before the title rather than last.
+	LinkFirst bool `json:"link_first,omitempty"`
+	// MaxBody, if set, is the most characters the message may have.
+	MaxBody int `json:"max_body,omitempty"`
+	// Message, if set, is sent as the message in place of the title, body
+	// and link.
+	Message string `json:"message,omitempty"`
+	// Timeout overrides notifyClient's timeout for this notification. It
+	// is not kept in the dead-letter file, so redeliveries use the default.
+	Timeout time.Duration `json:"-"`
+	// Actions is the JSON value of the X-Actions header.
+	Actions string `json:"actions,omitempty"`
+}
+
+// Action is an ntfy action button. URL, Body and header values are
+// templates rendered against the item (see templateData); a view action
+// without a URL opens the item's link.
+type Action struct {
+	Action  string            `yaml:"action" json:"action"`
+	Label   string            `yaml:"label" json:"label"`
+	URL     string            `yaml:"url" json:"url,omitempty"`
+	Method  string            `yaml:"method" json:"method,omitempty"`
+	Headers map[string]string `yaml:"headers" json:"headers,omitempty"`
+	Body    string            `yaml:"body" json:"body,omitempty"`
+	Clear   bool              `yaml:"clear" json:"clear,omitempty"`
+}
+
+// ExecHook is a command run for each new item before its notification is
+// sent. Command elements are templates rendered against the item (see
+// templateData), and the item is also passed in the RSS_TITLE, RSS_LINK and
+// RSS_FEED environment variables.
+type ExecHook struct {
+	Command []string `yaml:"command"`
+	// Timeout bounds how long the command may run, 30 seconds by default.
+	Timeout time.Duration `yaml:"timeout"`
+	// Gate skips the notification when the command exits non-zero or
+	// cannot be run.
+	Gate bool `yaml:"gate"`
+	// Instead runs the command in place of sending a notification.
+	Instead bool `yaml:"instead"`
+}
+
+// Login is a form posted to URL, with the given fields, before fetching a
+// feed that needs a session cookie.
+type Login struct {
+	URL    string            `yaml:"url"`
+	Fields map[string]string `yaml:"fields"`
+}
+
+// Filter is a set of conditions on an item. It matches an item that meets
+// every condition it sets, matches all the filters of All and, if it has
+// Any, at least one of those. Text is compared ignoring case: Title and
+// Author match when the item's title or author contains them, Category when
+// one of its categories equals it. Regex is matched against the title and
+// the content, and Match is an expression as for Feed.Match.
+type Filter struct {
+	All      []Filter `yaml:"all"`
+	Any      []Filter `yaml:"any"`
+	Title    string   `yaml:"title"`
+	Category string   `yaml:"category"`
+	Author   string   `yaml:"author"`
+	Regex    string   `yaml:"regex"`
+	Match    string   `yaml:"match"`
+
+	// regex is Regex compiled by loadConfig.
+	regex *regexp.Regexp
+}
+
+// filterItem is what filters see of an item or entry.
+type filterItem struct {
+	title, author, content, raw string
+	categories                  []string
+}
+
+// compile checks the filter and those nested in it, compiling their
+// regexes.
+func (f *Filter) compile() error {
+	if len(f.All) == 0 && len(f.Any) == 0 && f.Title == "" && f.Category == "" && f.Author == "" && f.Regex == "" && f.Match == "" {
+		return errors.New("a filter needs at least one of all, any, title, category, author, regex or match")
+	}
+	if f.Regex != "" {
+		re, err := regexp.Compile(f.Regex)
+		if err != nil {
+			return fmt.Errorf("regex: %w", err)
+		}
+		f.regex = re
+	}
+	if _, err := parseMatch(f.Match); err != nil {
+		return fmt.Errorf("match: %w", err)
+	}
+	for i := range f.All {
+		if err := f.All[i].compile(); err != nil {
+			return fmt.Errorf("all %d: %w", i+1, err)
+		}
+	}
+	for i := range f.Any {
+		if err := f.Any[i].compile(); err != nil {
+			return fmt.Errorf("any %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the item meets the filter. A nil filter matches
+// every item.
+func (f *Filter) matches(item filterItem) bool {
+	if f == nil {
+		return true
+	}
+	if f.Title != "" && !containsFold(item.title, f.Title) {
+		return false
+	}
+	if f.Author != "" && !containsFold(item.author, f.Author) {
+		return false
+	}
+	if f.Category != "" && !slices.ContainsFunc(item.categories, func(c string) bool {
+		return strings.EqualFold(strings.TrimSpace(c), f.Category)
+	}) {
+		return false
+	}
+	if f.regex != nil && !f.regex.MatchString(item.title) && !f.regex.MatchString(item.content) {
+		return false
+	}
+	if !itemMatches(f.Match, item.raw) {
+		return false
+	}
+	for i := range f.All {
+		if !f.All[i].matches(item) {
+			return false
+		}
+	}
+	if len(f.Any) == 0 {
+		return true
+	}
+	for i := range f.Any {
+		if f.Any[i].matches(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether s contains substr, ignoring case.
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// Rule changes how an item is notified when it matches: its title contains
+// one of Keywords (ignoring case), or Match (see parseMatch) matches it. A
+// rule with both must match both.
+type Rule struct {
+	Keywords []string `yaml:"keywords"`
+	Match    string   `yaml:"match"`
+	// MessageTemplate (see templateData) replaces the whole message.
+	MessageTemplate string `yaml:"message_template"`
+	Priority        int    `yaml:"priority"`
+	// Tags replaces the notification's tags, such as "warning,skull".
+	Tags string `yaml:"tags"`
+}
+
+// matches reports whether the item with title and XML raw matches the rule.
+func (r *Rule) matches(title, raw string) bool {
+	if len(r.Keywords) > 0 {
+		lower := strings.ToLower(title)
+		found := false
+		for _, keyword := range r.Keywords {
+			if strings.Contains(lower, strings.ToLower(keyword)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return itemMatches(r.Match, raw)
+}
+
+// matchedRule returns the feed's first rule matching the item, or nil.
+func matchedRule(feed *Feed, title, raw string) *Rule {
+	for i := range feed.Rules {
+		if feed.Rules[i].matches(title, raw) {
+			return &feed.Rules[i]
+		}
+	}
+	return nil
+}
+
+// applyRule overrides n with the message and tags of rule, if any.
+func applyRule(rule *Rule, n *Notification, data templateData) error {
+	if rule == nil {
+		return nil
+	}
+	if rule.MessageTemplate != "" {
+		message, err := renderTemplate(rule.MessageTemplate, data)
+		if err != nil {
+			return fmt.Errorf("error rendering message_template: %w", err)
+		}
+		n.Message = message
+	}
+	if rule.Tags != "" {
+		n.Tags = rule.Tags
+	}
+	return nil
+}
+
+// templateData holds the item fields available to templates in the config.
+type templateData struct {
+	Title string
+	Link  string
+	Feed  string
+	// Category is the item's first category, or "" if it has none.
+	Category string
+	// Author is the name (or, for some RSS feeds, email address) of the
+	// item's author, or "".
+	Author string
+	// Source is the title of the feed an aggregator took the item from,
+	// or "".
+	Source string
+	// Published is the item's date in displayLocation, or the zero time if
+	// it has none.
+	Published time.Time
+}
+
+// graceUntil is the end of the startup_grace period.
+var graceUntil time.Time
+
+// inStartupGrace reports whether notifications are suppressed because the
+// program only just started.
+func inStartupGrace() bool {
+	return clock.Now().Before(graceUntil)
+}
+
+// displayLocation is the display_timezone that templates see dates in.
+var displayLocation = time.UTC
+
+// templateFuncs are the functions available in templates. localtime
+// converts a time to the named zone, as in
+// {{.Published | localtime "America/New_York"}}.
+var templateFuncs = template.FuncMap{
+	"localtime": func(zone string, t time.Time) (time.Time, error) {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return t.In(loc), nil
+	},
+}
+
+// publishedIn returns published in displayLocation, keeping it zero when
+// the item has no date.
+func publishedIn(published time.Time) time.Time {
+	if published.IsZero() {
+		return published
+	}
+	return published.In(displayLocation)
+}
+
+type Feed struct {
+	URL       string `yaml:"url"`
+	NtfyTopic string `yaml:"ntfy_topic"`
+	NtfyToken string `yaml:"ntfy_token"`
+	Icon      string `yaml:"icon"`
+	Priority  int    `yaml:"priority"`
+	// Importance names the priority of the feed's notifications: low,
+	// default, high or urgent. Priority takes precedence when set.
+	Importance string `yaml:"importance"`
+	// Email additionally forwards the feed's notifications to this address.
+	Email string `yaml:"email"`
+	// Call is a phone number (or "yes" for the account's verified number)
+	// that ntfy calls for items with at least CallMinPriority, which
+	// defaults to 5.
+	Call            string    `yaml:"call"`
+	CallMinPriority int       `yaml:"call_min_priority"`
+	Actions         []Action  `yaml:"actions"`
+	Exec            *ExecHook `yaml:"exec"`
+	// GroupKey is a template (see templateData) whose result is sent as
+	// the notification's tag, so related notifications can be grouped.
+	GroupKey string `yaml:"group_key"`
+	// Tags are templates (see templateData) rendered into the
+	// notification's tags.
+	Tags []string `yaml:"tags"`
+	// Match is an expression over the item's XML (see parseMatch); only
+	// items it matches are notified.
+	Match string `yaml:"match"`
+	// Filter, if set, is the conditions items must meet to be notified.
+	Filter *Filter `yaml:"filter"`
+	// CategoryTopics maps item categories, ignoring case, to the topics
+	// their items are sent to instead of the feed's topic. An item in
+	// several mapped categories is sent to each of their topics.
+	CategoryTopics map[string]string `yaml:"category_topics"`
+	// Rules override the notification of items matching one of them; the
+	// first rule that matches applies.
+	Rules []Rule `yaml:"rules"`
+	// Labels categorize the feed for matching by routes.
+	Labels []string `yaml:"labels"`
+	// PriorityKeywords maps a keyword to the priority used for items whose
+	// title contains it. When several keywords match, the highest wins.
+	PriorityKeywords map[string]int `yaml:"priority_keywords"`
+	// Method and Body customize the request used to fetch the feed. The
+	// default is a GET with no body.
+	Method string `yaml:"method"`
+	Body   string `yaml:"body"`
+	// Login is a form posted to get the session cookies the feed needs.
+	Login *Login `yaml:"login"`
+	// QuietRecovery makes the first successful check after the feed has
+	// been failing for longer than its interval behave like a first check,
+	// so the items published during the outage aren't all notified.
+	QuietRecovery bool `yaml:"quiet_recovery"`
+	// AlertOnEmpty notifies the error topic when the feed, after having
+	// items, parses to none.
+	AlertOnEmpty bool `yaml:"alert_on_empty"`
+	// DedupMode selects how new items are detected: "timestamp" (the
+	// default) notifies items published after the last seen one, "bloom"
+	// notifies items whose GUID is not in a persisted bloom filter and
+	// "hash" notifies items whose title and link have not been seen, for
+	// feeds without usable dates.
+	DedupMode              string  `yaml:"dedup_mode"`
+	BloomCapacity          int     `yaml:"bloom_capacity"`
+	BloomFalsePositiveRate float64 `yaml:"bloom_false_positive_rate"`
+	// MinInterval is the least time between two polls of this feed, even if
+	// the check interval is shorter.
+	MinInterval time.Duration `yaml:"min_interval"`
+	// NotifyOnRemoval also notifies when an item that was present in the
+	// previous poll disappears from the feed.
+	NotifyOnRemoval bool `yaml:"notify_on_removal"`
+	// NotifyOnContentChange also notifies when the title or content of an
+	// item that was already seen changes.
+	NotifyOnContentChange bool `yaml:"notify_on_content_change"`
+	// DedupGroup names a set of feeds that mirror each other, such as the
+	// HTTP and HTTPS URLs of one feed. They share their seen-item state, so
+	// an item notified via one feed is not notified again via another.
+	DedupGroup string `yaml:"dedup_group"`
+	// HTMLContent adds the item's HTML content to the notification,
+	// converted to Markdown with only a safe subset of formatting kept.
+	HTMLContent bool `yaml:"html_content"`
+	// DateFields lists the date fields to take an item's date from, the
+	// first non-empty one winning (see dateFieldNames). By default RSS
+	// items use pubDate and Atom entries published.
+	DateFields []string `yaml:"date_fields"`
+	// FutureDates is what to do with items dated in the future: "keep"
+	// (the default), "clamp" or "skip" (see futureDate).
+	FutureDates string `yaml:"future_dates"`
+	// Throttle sends at most one notification per window. Items that would
+	// be notified sooner are held and sent together as one digest by the
+	// first check after the window ends.
+	Throttle time.Duration `yaml:"throttle"`
+	// SingleLine sends the notification as one line, its parts joined by
+	// singleLineSeparator.
+	SingleLine bool `yaml:"single_line"`
+	// LinkPosition is where the link goes in the message: "after" the
+	// title and body (the default) or "before" them.
+	LinkPosition string `yaml:"link_position"`
+	// Separator joins the title, body and link of the message in place of
+	// a blank line, or of singleLineSeparator with single_line.
+	Separator string `yaml:"separator"`
+	// MaxBody truncates messages longer than this many characters, for
+	// topics mirrored somewhere with tight limits, such as SMS.
+	MaxBody int `yaml:"max_body"`
+	// HostGroup names a set of feeds that are checked one after another
+	// rather than concurrently, to go easy on a shared server. "auto"
+	// groups the feed with the others on the same host.
+	HostGroup string `yaml:"host_group"`
+	// BootstrapSince makes the first poll notify items published within
+	// this long before startup, instead of none.
+	BootstrapSince time.Duration `yaml:"bootstrap_since"`
+	// MaxItemAge skips notifying new items published longer ago than this.
+	// They are still recorded as seen.
+	MaxItemAge time.Duration `yaml:"max_item_age"`
+	// NotBefore is a fixed floor: items published before it are never
+	// notified.
+	NotBefore time.Time `yaml:"not_before"`
+	// Tor fetches the feed through the Tor proxy. Feeds on .onion hosts
+	// always are.
+	Tor bool `yaml:"tor"`
+	// IgnoreContentType parses the response whatever its Content-Type, for
+	// servers that label their feed as something else, such as text/html.
+	IgnoreContentType bool `yaml:"ignore_content_type"`
+	// APIKeyParam and APIKey add an API key to the feed's query string
+	// when it is requested, keeping it out of url and therefore the logs.
+	APIKeyParam string `yaml:"api_key_param"`
+	APIKey      string `yaml:"api_key"`
+	// FetchTimeout and NotifyTimeout replace the 30 second timeouts of
+	// fetching the feed and of sending each of its notifications.
+	FetchTimeout  time.Duration `yaml:"fetch_timeout"`
+	NotifyTimeout time.Duration `yaml:"notify_timeout"`
+	// ProcessTimeout bounds a whole check of the feed, after which the
+	// check is given up on so it can't hold up the other feeds.
+	ProcessTimeout time.Duration `yaml:"process_timeout"`
+	// NewestOnly notifies only the newest of the items that are new in a
+	// check. The others are recorded as seen.
+	NewestOnly bool `yaml:"newest_only"`
+	// Format forces the feed to be parsed as "rss", "atom" or "json"
+	// instead of detecting its format ("auto", the default). "hfeed" is for
+	// HTML pages publishing an h-feed, which is never detected.
+	Format string `yaml:"format"`
+	// Group names an entry of the top-level groups, whose interval replaces
+	// the check interval for this feed.
+	Group string `yaml:"group"`
+	// Splitter names an entry of splitters that divides the response into
+	// several feed documents, whose items are checked as one feed.
+	Splitter string `yaml:"splitter"`
+	// ShowSource prefixes notification titles with the name of the feed
+	// an aggregator took the item from, when the item gives it.
+	ShowSource bool `yaml:"show_source"`
+	// Schedule is a cron expression (see parseSchedule) limiting when the
+	// feed is checked, such as "* 9-17 * * 1-5" for weekday working hours.
+	Schedule string `yaml:"schedule"`
+
+	LastUpdate time.Time    `yaml:"-"`
+	seen       *bloomFilter `yaml:"-"`
+	hashes     *hashSet     `yaml:"-"`
+	// primed is set once the feed's seen-set has been populated by a
+	// successful poll, so the first poll does not notify every item.
+	primed      bool      `yaml:"-"`
+	lastSuccess time.Time `yaml:"-"`
+	lastPoll    time.Time `yaml:"-"`
+	// jar holds the session cookies of Login once logged in.
+	jar http.CookieJar `yaml:"-"`
+	// itemCount is the number of items in the feed at the last check.
+	itemCount int `yaml:"-"`
+	// failures counts the checks that failed since the last successful
+	// one, which failed at failingSince, and notified the notifications
+	// sent since startup.
+	failures     int       `yaml:"-"`
+	failingSince time.Time `yaml:"-"`
+	notified     int       `yaml:"-"`
+	// processing is set while a check given up on after ProcessTimeout is
+	// still running. It is guarded by statsMu.
+	processing bool `yaml:"-"`
+	// lastNotified is when the throttle window started, and held the
+	// notifications waiting for its digest.
+	lastNotified time.Time      `yaml:"-"`
+	held         []Notification `yaml:"-"`
+	// clamped maps the keys of items with future dates to when they were
+	// first seen, for future_dates: clamp.
+	clamped map[string]time.Time `yaml:"-"`
+	// itemHashes maps item keys to their content hashes, for
+	// NotifyOnContentChange. It is nil until the first poll.
+	itemHashes map[string]string `yaml:"-"`
+	// schedule is Schedule parsed by loadConfig, or nil.
+	schedule *cronSchedule `yaml:"-"`
+	// interval is how often the feed is due to be checked, set by
+	// scheduleFeeds. Zero means every check.
+	interval time.Duration `yaml:"-"`
+	// present is the item set from the last poll, used by NotifyOnRemoval.
+	// It is nil until the first poll.
+	present []presentItem `yaml:"-"`
+}
+
+// State is the per-feed state persisted between runs, keyed by feed URL.
+type State struct {
+	Feeds map[string]*FeedState `json:"feeds"`
+	// Pending is the notification outbox, sent on the next check.
+	Pending []Notification `json:"pending,omitempty"`
+}
+
+type FeedState struct {
+	LastUpdate time.Time     `json:"last_update"`
+	LastPoll   time.Time     `json:"last_poll"`
+	Bloom      *bloomFilter  `json:"bloom,omitempty"`
+	Hashes     []string      `json:"hashes,omitempty"`
+	Present    []presentItem `json:"present,omitempty"`
+	// LastNotified and Held are the feed's throttle window.
+	LastNotified time.Time      `json:"last_notified,omitempty"`
+	Held         []Notification `json:"held,omitempty"`
+	// Clamped is the feed's future_dates: clamp record.
+	Clamped map[string]time.Time `json:"clamped,omitempty"`
+	// ItemHashes is the feed's notify_on_content_change record.
+	ItemHashes map[string]string `json:"item_hashes,omitempty"`
+	// ItemCount is the number of items at the last check, for
+	// alert_on_empty.
+	ItemCount int `json:"item_count,omitempty"`
+}
+
+// presentItem identifies an item seen in a feed's latest poll.
+type presentItem struct {
+	Key   string `json:"key"`
+	Title string `json:"title"`
+	Link  string `json:"link"`
+}
+
+// hashSet holds the item hashes seen by a feed in hash dedup mode, oldest
+// first. Once it holds hashSetCapacity hashes the oldest are forgotten.
+type hashSet struct {
+	keys  []string
+	index map[string]bool
+}
+
+const hashSetCapacity = 10000
+
+// bloomFilter is a fixed-size probabilistic set. Membership tests may return
+// false positives at roughly the configured rate, but never false negatives.
+type bloomFilter struct {
+	Bits   []byte `json:"bits"`
+	Hashes int    `json:"hashes"`
+}
+
+type Config struct {
+	Interval       time.Duration        `yaml:"interval"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+	RateLimit      RateLimitConfig      `yaml:"rate_limit"`
+	Routes         []Route              `yaml:"routes"`
+	// Defaults holds feed settings applied to every feed that doesn't set
+	// them itself. It accepts the same keys as a feed, except url.
+	Defaults yaml.MapSlice `yaml:"defaults"`
+	// MaxFeedSize is how many bytes of a response are read looking for the
+	// first feed item before the response is rejected.
+	MaxFeedSize int64 `yaml:"max_feed_size"`
+	// TLSMinVersion is the lowest TLS version negotiated with feeds and ntfy
+	// servers, "1.2" by default.
+	TLSMinVersion string    `yaml:"tls_min_version"`
+	Tor           TorConfig `yaml:"tor"`
+	// IPPreference, "ipv4" or "ipv6", is the address family connections
+	// try first. FallbackDelay is how long a dual-stack connection waits
+	// for the first address family before also trying the other, 300ms by
+	// default.
+	IPPreference  string        `yaml:"ip_preference"`
+	FallbackDelay time.Duration `yaml:"fallback_delay"`
+	// Groups maps a group name to the check interval of the feeds in it.
+	Groups map[string]time.Duration `yaml:"groups"`
+	// NotifyWorkers is how many notifications are sent concurrently, 4 by
+	// default.
+	NotifyWorkers int               `yaml:"notify_workers"`
+	NotifyRetry   NotifyRetryConfig `yaml:"notify_retry"`
+	// StaggerStart spreads the first poll of each feed randomly over its
+	// check interval instead of polling every feed at startup.
+	StaggerStart bool `yaml:"stagger_start"`
+	// StartupGrace is how long after startup new items are only recorded as
+	// seen, without notifying them.
+	StartupGrace time.Duration `yaml:"startup_grace"`
+	// DisplayTimezone is the zone dates are shown in by templates, UTC by
+	// default.
+	DisplayTimezone string `yaml:"display_timezone"`
+	// ErrorTopic is notified when a reload of the config file fails or a
+	// feed with AlertOnEmpty becomes empty.
+	ErrorTopic string `yaml:"error_topic"`
+	Feeds      []Feed `yaml:"feeds"`
+
+	// tlsMinVersion is TLSMinVersion parsed by loadConfig.
+	tlsMinVersion uint16
+	// displayLocation is DisplayTimezone loaded by loadConfig.
+	displayLocation *time.Location
+}
+
+// Route sends notifications from matching feeds to a different topic. Label
+// and URL are glob patterns (as in path.Match); a route matches a feed when
+// every pattern it sets matches, with Label matching any of the feed's
+// labels. Routes are checked in order and the first match overrides the
+// feed's ntfy_topic.
+type Route struct {
+	Label     string `yaml:"label"`
+	URL       string `yaml:"url"`
+	NtfyTopic string `yaml:"ntfy_topic"`
+}
+
+func (r Route) matches(feed *Feed) bool {
+	if r.URL != "" {
+		if ok, _ := path.Match(r.URL, feed.URL); !ok {
+			return false
+		}
+	}
+	if r.Label != "" {
+		for _, label := range feed.Labels {
+			if ok, _ := path.Match(r.Label, label); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// RateLimitConfig limits how many notifications are sent across all feeds.
+// Up to Burst notifications may be sent at once, refilling at Notifications
+// per Period. Excess notifications wait for a token rather than being
+// dropped.
+type RateLimitConfig struct {
+	Notifications int           `yaml:"notifications"`
+	Period        time.Duration `yaml:"period"`
+	Burst         int           `yaml:"burst"`
+}
+
+// tokenBucket is a rate limiter shared by all notification sends.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	burst  float64
+	rate   float64 // tokens per second
+	last   time.Time
+}
+
+// notifyLimiter is nil when notifications are not rate limited.
+var notifyLimiter *tokenBucket
+
+// notifyClient sends notifications. Its timeout makes a hung ntfy server count
+// as a failed send for the circuit breaker instead of blocking forever.
+var notifyClient = &http.Client{Timeout: time.Second * 30}
+
+// maxFeedSize is the configured MaxFeedSize, defaulting to 10 MiB.
+var maxFeedSize = defaultMaxFeedSize
+
+const defaultMaxFeedSize int64 = 10 << 20
+
+// routes are the topic routing rules from the config.
+var routes []Route
+
+// errorTopic is the config's error_topic, notified by reportError.
+var errorTopic string
+
+// topicTokens holds the credentials loaded from -auth-file, keyed by topic
+// URL or by server URL (scheme and host) to cover every topic on a server.
+var topicTokens = map[string]string{}
+
+// TorConfig sets up the client used for onion feeds and feeds with tor set.
+type TorConfig struct {
+	// Proxy is the Tor SOCKS proxy, such as socks5://127.0.0.1:9050.
+	Proxy string `yaml:"proxy"`
+	// Timeout replaces the normal 30 second fetch timeout, since requests
+	// through Tor are much slower. It defaults to 2 minutes.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// torClient fetches feeds that go through Tor. It is nil unless a Tor proxy
+// is configured.
+var torClient *http.Client
+
+// NotifyRetryConfig is the policy for notifications that fail to send.
+type NotifyRetryConfig struct {
+	// Attempts is how many times a send is tried before it counts as failed,
+	// 1 by default.
+	Attempts int `yaml:"attempts"`
+	// Backoff is the wait before the first retry, doubled before each later
+	// one. It defaults to 1 second.
+	Backoff time.Duration `yaml:"backoff"`
+	// Redeliveries is how many later checks a failed notification is retried
+	// on from the dead-letter queue before it is dropped, 10 by default.
+	Redeliveries int `yaml:"redeliveries"`
+	// Persist queues failed notifications for redelivery. When true the
+	// queue is kept in the -dead-letter file across restarts, when false it
+	// is kept in memory only. Unset, failed notifications are queued only
+	// if -dead-letter is given.
+	Persist *bool `yaml:"persist"`
+}
+
+// notifyRetry is the retry policy used by notify and the dead-letter queue.
+var notifyRetry = NotifyRetryConfig{Attempts: 1, Backoff: time.Second, Redeliveries: 10}
+
+// CircuitBreakerConfig controls when sends to an ntfy server are
+// short-circuited after repeated failures.
+type CircuitBreakerConfig struct {
+	Failures int           `yaml:"failures"`
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// circuitBreaker tracks consecutive send failures for a single ntfy server.
+// Once the failure threshold is reached it opens and rejects sends until the
+// cooldown elapses, then lets a single trial send through (half-open).
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+var (
+	breakerConfig = CircuitBreakerConfig{Failures: 5, Cooldown: time.Minute}
+	breakersMu    sync.Mutex
+	breakers      = map[string]*circuitBreaker{}
+)
+
+func main() {
+	log.SetFormatter(&log.JSONFormatter{
+		TimestampFormat: "2006-01-02 15:04:05",
+	})
+
+	var intervalFlag string
+	var configFile string
+	var stateFile string
+	var authFile string
+	var statusFile string
+	var listFormatsURL string
+	var verify bool
+	var initConfig bool
+	var previewAddr string
+	var diffFile string
+	var dumpSize int
+	var deadLetterFile string
+	var logLevel string
+	var pruneStateFlag bool
+	var maxCycles int
+	var replay time.Duration
+	var backfill int
+	var maxRuntime time.Duration
+
+	flag.StringVar(&intervalFlag, "interval", "10m", "Check interval (e.g., 30s, 20m, 2h)")
+	flag.StringVar(&configFile, "config", "", "Path or http(s) URL of config file")
+	flag.StringVar(&configCacheFile, "config-cache", "", "Path to file keeping the last good copy of a -config URL, used when it can't be fetched (optional)")
+	flag.StringVar(&stateFile, "state", "", "Path to state file persisted between runs (optional)")
+	flag.StringVar(&statusFile, "status-file", "", "Path to status file updated after each check, e.g. for a healthcheck (optional)")
+	flag.StringVar(&deadLetterFile, "dead-letter", "", "Path to file queueing notifications that failed to send, retried on each check (optional)")
+	flag.StringVar(&authFile, "auth-file", "", "Path to YAML file mapping ntfy topic or server URLs to access tokens (optional)")
+	flag.StringVar(&logLevel, "log-level", "info", "Log level (debug, info, warn, error)")
+	flag.StringVar(&listFormatsURL, "list-formats", "", "Fetch a feed, print its item dates and which date layouts they match, then exit")
+	flag.StringVar(&parseDumpDir, "dump-parse-errors", "", "Directory to write the response body of feeds that fail to parse to, for debugging (optional)")
+	flag.IntVar(&dumpSize, "dump-size", 64<<10, "Maximum number of body bytes written by -dump-parse-errors")
+	flag.DurationVar(&replay, "replay", 0, "Notify every item published within this long, e.g. 24h, whatever was notified before, then exit")
+	flag.IntVar(&backfill, "backfill", 0, "Like -replay, also following up to this many next pages of paginated Atom feeds; alone, notifies every item found, then exits")
+	flag.IntVar(&maxCycles, "max-cycles", 0, "Exit after this many checks (optional)")
+	flag.DurationVar(&maxRuntime, "max-runtime", 0, "Exit instead of starting a check later than this after startup, e.g. 1h (optional)")
+	flag.BoolVar(&pruneStateFlag, "prune-state", false, "Remove the state of feeds no longer in the config from the -state file, then exit")
+	flag.BoolVar(&initConfig, "init", false, "Write a commented example config to the file given as argument (-init feeds.yaml), or to stdout, then exit")
+	flag.StringVar(&previewAddr, "preview-addr", "", "Serve previews of the notifications the configured feeds would send on this address, e.g. localhost:8080, instead of sending them")
+	flag.BoolVar(&verify, "verify", false, "Check that every ntfy topic can be reached and its token is accepted, print the result for each, then exit")
+	flag.StringVar(&diffFile, "diff", "", "Compare this config file with the one given as argument (-diff old.yaml new.yaml), print the differences, then exit")
+	flag.Parse()
+
+	parseDumpSize = dumpSize
+
+	level, err := log.ParseLevel(logLevel)
+	if err != nil {
+		log.Fatalf("Invalid log level: %v", err)
+	}
+	log.SetLevel(level)
+
+	if initConfig {
+		if err := writeExampleConfig(flag.Arg(0)); err != nil {
+			log.Fatalf("Error writing example config: %v", err)
+		}
+		return
+	}
+
+	if diffFile != "" {
+		if flag.NArg() != 1 {
+			log.Fatalf("Usage: %s -diff old.yaml new.yaml", os.Args[0])
+		}
+		if err := diffConfigFiles(os.Stdout, diffFile, flag.Arg(0)); err != nil {
+			log.Fatalf("Error comparing configs: %v", err)
+		}
+		return
+	}
+
+	if listFormatsURL != "" {
+		client := &http.Client{Timeout: time.Second * 30, Transport: newTransport(tls.VersionTLS12)}
+		if err := listFormats(listFormatsURL, client); err != nil {
+			log.Fatalf("Error listing date formats: %v", err)
+		}
+		return
+	}
+
+	if intervalFlag == "" || configFile == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s -interval <duration> [-config <path>]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExample:\n")
+		fmt.Fprintf(os.Stderr, "  %s -interval 10m -config /path/to/feeds.yaml\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	started := clock.Now()
+
+	log.Info("Reading config file")
+	config, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	// An empty config is valid YAML, but a program with no feeds would
+	// only ever sleep.
+	if len(config.Feeds) == 0 {
+		log.Fatalf("Config file %s has no feeds; list them under \"feeds:\"", configFile)
+	}
+
+	if pruneStateFlag {
+		if stateFile == "" {
+			log.Fatal("-prune-state needs -state")
+		}
+		removed, err := pruneState(stateFile, config.Feeds)
+		if err != nil {
+			log.Fatalf("Error pruning state: %v", err)
+		}
+		for _, u := range removed {
+			log.Infof("Removed state of feed %s", u)
+		}
+		log.Infof("Pruned %d state entries", len(removed))
+		return
+	}
+
+	// The interval from the config file is used unless -interval was given
+	// explicitly on the command line.
+	intervalSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "interval" {
+			intervalSet = true
+		}
+	})
+
+	flagInterval, err := time.ParseDuration(intervalFlag)
+	if err != nil {
+		log.Fatalf("Invalid interval format: %v", err)
+	}
+	checkInterval := func(c *Config) time.Duration {
+		if !intervalSet && c.Interval > 0 {
+			return c.Interval
+		}
+		return flagInterval
+	}
+	interval := checkInterval(config)
+	log.Infof("Using check interval: %v", interval)
+	tick := scheduleFeeds(config.Feeds, config.Groups, interval)
+	for name, groupInterval := range config.Groups {
+		log.Infof("Checking feeds in group %q every %v", name, groupInterval)
+	}
+
+	if stateFile != "" {
+		state, err := loadState(stateFile)
+		if err != nil {
+			log.Fatalf("Error loading state: %v", err)
+		}
+		applyState(config.Feeds, state)
+		outbox.restore(state.Pending)
+	}
+	if config.StaggerStart {
+		staggerFirstPolls(config.Feeds)
+	}
+
+	routes = config.Routes
+	errorTopic = config.ErrorTopic
+	displayLocation = config.displayLocation
+	if config.StartupGrace > 0 {
+		graceUntil = clock.Now().Add(config.StartupGrace)
+		log.Infof("Not notifying new items until %s", graceUntil.Format(time.RFC3339))
+	}
+	if config.MaxFeedSize > 0 {
+		maxFeedSize = config.MaxFeedSize
+	}
+
+	if authFile != "" {
+		tokens, err := loadAuthFile(authFile)
+		if err != nil {
+			log.Fatalf("Error loading auth file: %v", err)
+		}
+		topicTokens = tokens
+	}
+	if err := addEnvToken(topicTokens); err != nil {
+		log.Fatalf("Error reading environment: %v", err)
+	}
+
+	if config.CircuitBreaker.Failures > 0 {
+		breakerConfig.Failures = config.CircuitBreaker.Failures
+	}
+	if config.CircuitBreaker.Cooldown > 0 {
+		breakerConfig.Cooldown = config.CircuitBreaker.Cooldown
+	}
+
+	if rl := config.RateLimit; rl.Notifications > 0 {
+		notifyLimiter = newTokenBucket(rl)
+		log.Infof("Limiting notifications to %d per %v", rl.Notifications, rl.period())
+	}
+
+	if r := config.NotifyRetry; r.Attempts > 0 {
+		notifyRetry.Attempts = r.Attempts
+	}
+	if r := config.NotifyRetry; r.Backoff > 0 {
+		notifyRetry.Backoff = r.Backoff
+	}
+	if r := config.NotifyRetry; r.Redeliveries > 0 {
+		notifyRetry.Redeliveries = r.Redeliveries
+	}
+
+	persist := config.NotifyRetry.Persist
+	if persist != nil && *persist && deadLetterFile == "" {
+		log.Fatalf("notify_retry.persist needs -dead-letter to name the queue file")
+	}
+	if persist != nil && !*persist {
+		// Queue in memory only.
+		deadLetters = &deadLetterQueue{}
+		deadLetterFile = ""
+	}
+	if deadLetterFile != "" {
+		deadLetters, err = loadDeadLetters(deadLetterFile)
+		if err != nil {
+			log.Fatalf("Error loading dead letters: %v", err)
+		}
+	}
+
+	ipPreference = config.IPPreference
+	dialer.FallbackDelay = config.FallbackDelay
+	if ipPreference != "" {
+		log.Infof("Preferring %s connections", ipPreference)
+	}
+	transport := newTransport(config.tlsMinVersion)
+	notifyClient.Transport = transport
+	client := &http.Client{
+		Timeout:   time.Second * 30,
+		Transport: transport,
+	}
+
+	if verify {
+		if !verifyTopics(os.Stdout, config.Feeds, notifyClient) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if config.Tor.Proxy != "" {
+		// Validated by loadConfig.
+		proxyURL, _ := url.Parse(config.Tor.Proxy)
+		torTransport := newTransport(config.tlsMinVersion)
+		torTransport.Proxy = http.ProxyURL(proxyURL)
+		timeout := config.Tor.Timeout
+		if timeout == 0 {
+			timeout = 2 * time.Minute
+		}
+		torClient = &http.Client{Timeout: timeout, Transport: torTransport}
+		log.Infof("Fetching onion feeds through Tor proxy %s", proxyURL.Host)
+	}
+
+	if replay > 0 || backfill > 0 {
+		replayFeeds(config.Feeds, replay, backfill, client)
+		return
+	}
+
+	if previewAddr != "" {
+		log.Infof("Serving notification previews on http://%s", previewAddr)
+		log.Fatal(http.ListenAndServe(previewAddr, previewHandler(config.Feeds, client)))
+	}
+
+	workers := config.NotifyWorkers
+	if workers == 0 {
+		workers = 4
+	}
+	startNotifyWorkers(workers)
+
+	// configMu guards config, which a SIGHUP replaces, for the SIGUSR1
+	// handler.
+	var configMu sync.Mutex
+	stats := make(chan os.Signal, 1)
+	signal.Notify(stats, syscall.SIGUSR1)
+	go func() {
+		for range stats {
+			configMu.Lock()
+			feeds := config.Feeds
+			configMu.Unlock()
+			logStats(feeds, started)
+		}
+	}()
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+
+	limits := runLimits{maxCycles: maxCycles, maxRuntime: maxRuntime, started: started}
+
+	for cycle := 1; ; cycle++ {
+		first := cycle == 1
+		select {
+		case <-reloads:
+			log.Info("Reloading config file")
+			newConfig, err := reloadConfig(configFile, config)
+			if err != nil {
+				log.Errorf("Error reloading config, keeping the running config: %v", err)
+				reportError("config reload failed, still running the previous config", err.Error())
+				break
+			}
+			configMu.Lock()
+			config = newConfig
+			configMu.Unlock()
+			tick = scheduleFeeds(config.Feeds, config.Groups, checkInterval(config))
+			routes = config.Routes
+			errorTopic = config.ErrorTopic
+			displayLocation = config.displayLocation
+			maxFeedSize = defaultMaxFeedSize
+			if config.MaxFeedSize > 0 {
+				maxFeedSize = config.MaxFeedSize
+			}
+			log.Infof("Reloaded config, checking %d feeds", len(config.Feeds))
+		default:
+		}
+		if deadLetters != nil {
+			deadLetters.redeliver(config.Feeds)
+		}
+		outbox.retry(config.Feeds)
+		results := processFeedsAsync(config.Feeds, client)
+		if first {
+			retryNetworkFailures(config.Feeds, results, client)
+		}
+		sleep := nextSleep(config.Feeds, tick)
+		stop := limits.stop(cycle, sleep)
+		if stop != "" {
+			// Send what the last check found before saving the files
+			// for good.
+			outbox.drain()
+		}
+		// Taken first, as a notification that fails from now on moves
+		// from the outbox to the dead letters.
+		pending := outbox.pending()
+		queued := true
+		if deadLetterFile != "" {
+			if err := deadLetters.save(deadLetterFile); err != nil {
+				log.Errorf("Error saving dead letters: %v", err)
+				queued = false
+			}
+		}
+		// The state only moves past items whose failed notifications are
+		// safely in the dead-letter file, so they are checked again after
+		// a restart otherwise.
+		if !queued {
+			log.Warn("Not saving state until the dead letters are saved")
+		} else if stateFile != "" {
+			if err := saveState(stateFile, config.Feeds, pending); err != nil {
+				log.Errorf("Error saving state: %v", err)
+			}
+		}
+		if statusFile != "" {
+			if err := writeStatusFile(statusFile, clock.Now(), config.Feeds); err != nil {
+				log.Errorf("Error writing status file: %v", err)
+			}
+		}
+		if stop != "" {
+			log.Info(stop)
+			return
+		}
+		log.Infof("Sleeping for %v", sleep)
+		clock.Sleep(sleep)
+	}
+}
+
+// runLimits are the -max-cycles and -max-runtime limits of a run that
+// started at started. Zero limits don't apply.
+type runLimits struct {
+	maxCycles  int
+	maxRuntime time.Duration
+	started    time.Time
+}
+
+// stop returns why the run ends after check number cycle instead of
+// sleeping for sleep and checking again, or "" if it goes on.
+func (l runLimits) stop(cycle int, sleep time.Duration) string {
+	if l.maxCycles > 0 && cycle >= l.maxCycles {
+		return fmt.Sprintf("Exiting after %d checks", cycle)
+	}
+	if l.maxRuntime > 0 && clock.Now().Add(sleep).Sub(l.started) > l.maxRuntime {
+		return fmt.Sprintf("Exiting, the next check would start after -max-runtime of %v", l.maxRuntime)
+	}
+	return ""
+}
+
+// replayFeeds notifies every item of each feed published within lookback,
+// or every item if lookback is zero, ignoring which items were seen before
+// and startup_grace. Up to pages further pages of a paginated Atom feed
+// (RFC 5005) are included. The feeds themselves are not changed, so the
+// state file is unaffected.
+func replayFeeds(feeds []Feed, lookback time.Duration, pages int, client *http.Client) {
+	graceUntil = time.Time{}
+	var since time.Time
+	if lookback > 0 {
+		since = clock.Now().Add(-lookback)
+	}
+	for _, feed := range feeds {
+		replay := feed
+		replay.DedupMode = ""
+		replay.seen, replay.hashes, replay.present = nil, nil, nil
+		replay.NotifyOnRemoval = false
+		replay.NewestOnly = false
+		replay.Throttle, replay.held = 0, nil
+
+		visited := map[string]bool{}
+		for page := 0; page <= pages && replay.URL != "" && !visited[replay.URL]; page++ {
+			visited[replay.URL] = true
+			// Later pages hold older items, so every page starts from
+			// the same floor.
+			replay.LastUpdate = since
+
+			logger := log.WithField("feed", replay.URL)
+			result := processFeed(&replay, client)
+			if result.Err != nil {
+				logger.Errorf("Error replaying feed: %v", result.Err)
+				break
+			}
+			logger.Infof("Replayed %d of %d items", result.Notified, result.Parsed)
+			replay.URL = result.Next
+		}
+	}
+}
+
+// previewHandler serves the -preview-addr pages. The index lists the feeds,
+// and ?feed=<url> checks that feed and shows the ntfy request of each
+// notification it would send, without sending any. Items are new as in a
+// normal check, unless &since=<duration> asks for every item published
+// within that window, as -replay does. Previews never change the feeds'
+// state, and neither exec hooks nor error_topic notifications run. The
+// captured notifications bypass the send path, so previews don't use up
+// the rate limit or count against circuit breakers.
+func previewHandler(feeds []Feed, client *http.Client) http.Handler {
+	graceUntil = time.Time{}
+	errorTopic = ""
+	// outbox is swapped for each preview, so previews run one at a time.
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		feedURL := r.URL.Query().Get("feed")
+		if feedURL == "" {
+			fmt.Fprint(w, "<!DOCTYPE html><title>rss-to-ntfy preview</title><h1>Feeds</h1><ul>")
+			for _, feed := range feeds {
+				fmt.Fprintf(w, `<li><a href="?feed=%s">%s</a> (<a href="?feed=%[1]s&amp;since=24h">last 24h</a>)</li>`,
+					html.EscapeString(url.QueryEscape(feed.URL)), html.EscapeString(redactURL(feed.URL)))
+			}
+			fmt.Fprint(w, "</ul>")
+			return
+		}
+
+		var feed *Feed
+		for i := range feeds {
+			if feeds[i].URL == feedURL {
+				feed = &feeds[i]
+			}
+		}
+		if feed == nil {
+			http.Error(w, "feed not in the config", http.StatusNotFound)
+			return
+		}
+		var since time.Duration
+		if value := r.URL.Query().Get("since"); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid since duration", http.StatusBadRequest)
+				return
+			}
+			since = d
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		var captured []Notification
+		saved := outbox
+		outbox = newNotifyOutbox()
+		outbox.capture = func(n Notification) { captured = append(captured, n) }
+		defer func() { outbox = saved }()
+
+		preview := previewFeed(feed, since)
+		result := processFeed(&preview, client)
+
+		fmt.Fprintf(w, "<!DOCTYPE html><title>rss-to-ntfy preview</title><p><a href=\"?\">Feeds</a></p><h1>%s</h1>", html.EscapeString(redactURL(feed.URL)))
+		if result.Err != nil {
+			fmt.Fprintf(w, "<p>Error: %s</p>", html.EscapeString(result.Err.Error()))
+		}
+		fmt.Fprintf(w, "<p>%d items, %d new, %d notifications</p>", result.Parsed, result.New, len(captured))
+		for _, n := range captured {
+			req, err := ntfyRequest(r.Context(), n)
+			if err != nil {
+				fmt.Fprintf(w, "<hr><p>Error: %s</p>", html.EscapeString(err.Error()))
+				continue
+			}
+			fmt.Fprintf(w, "<hr><pre>POST %s\n", html.EscapeString(redactURL(req.URL.String())))
+			var names []string
+			for name := range req.Header {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				value := req.Header.Get(name)
+				if name == "Authorization" {
+					value = "REDACTED"
+				}
+				fmt.Fprintf(w, "%s: %s\n", html.EscapeString(name), html.EscapeString(value))
+			}
+			fmt.Fprintf(w, "\n%s</pre>", html.EscapeString(n.message()))
+		}
+	})
+}
+
+// previewFeed returns a copy of feed for a preview, sharing none of the
+// state a check changes. With since, it notifies every item published
+// within that window, like replayFeeds.
+func previewFeed(feed *Feed, since time.Duration) Feed {
+	preview := *feed
+	preview.Exec = nil
+	preview.Throttle, preview.held = 0, nil
+	if feed.seen != nil {
+		preview.seen = &bloomFilter{Bits: slices.Clone(feed.seen.Bits), Hashes: feed.seen.Hashes}
+	}
+	if feed.hashes != nil {
+		preview.hashes = &hashSet{keys: slices.Clone(feed.hashes.keys), index: maps.Clone(feed.hashes.index)}
+	}
+	if since > 0 {
+		preview.DedupMode = ""
+		preview.seen, preview.hashes, preview.present = nil, nil, nil
+		preview.NotifyOnRemoval = false
+		preview.NewestOnly = false
+		preview.LastUpdate = clock.Now().Add(-since)
+	}
+	return preview
+}
+
+// processFeedsAsync checks every feed that is due and returns the results of
+// those checks, in no particular order.
+func processFeedsAsync(feeds []Feed, client *http.Client) []FeedResult {
+	var wg sync.WaitGroup
+	var resultsMu sync.Mutex
+	var results []FeedResult
+
+	groups := map[string][]*Feed{}
+	var due []*Feed
+	for i := range feeds {
+		feed := &feeds[i]
+		if feed.DedupGroup != "" {
+			groups[feed.DedupGroup] = append(groups[feed.DedupGroup], feed)
+		}
+
+		now := clock.Now()
+		if feed.interval > 0 && !feed.lastPoll.IsZero() && now.Sub(feed.lastPoll) < feed.interval {
+			log.WithField("feed", feed.URL).Debugf("Feed not due until %s", feed.lastPoll.Add(feed.interval).Format(time.RFC3339))
+			continue
+		}
+		if feed.MinInterval > 0 && !feed.lastPoll.IsZero() && now.Sub(feed.lastPoll) < feed.MinInterval {
+			log.WithField("feed", feed.URL).Infof("Skipping feed until %s to respect min_interval of %v", feed.lastPoll.Add(feed.MinInterval).Format(time.RFC3339), feed.MinInterval)
+			continue
+		}
+		if feed.schedule != nil && !feed.schedule.matches(now.In(displayLocation)) {
+			log.WithField("feed", feed.URL).Debugf("Skipping feed outside its schedule %q", feed.Schedule)
+			continue
+		}
+		statsMu.Lock()
+		processing := feed.processing
+		statsMu.Unlock()
+		if processing {
+			log.WithField("feed", feed.URL).Warnf("Skipping feed, a check that exceeded process_timeout is still running")
+			continue
+		}
+		feed.lastPoll = now
+		due = append(due, feed)
+	}
+	batches := batchFeeds(due)
+
+	for _, batch := range batches {
+		wg.Add(1)
+		go func(batch []*Feed) {
+			defer wg.Done()
+			for _, feed := range batch {
+				if feed.DedupGroup != "" {
+					syncDedupGroup(feed, groups[feed.DedupGroup])
+				}
+				result := processFeedWithin(feed, client)
+				recordResult(feed, result)
+				resultsMu.Lock()
+				results = append(results, result)
+				resultsMu.Unlock()
+				if result.Err != nil {
+					log.WithField("feed", feed.URL).Errorf("Error processing feed: %v", result.Err)
+				}
+			}
+		}(batch)
+	}
+
+	wg.Wait()
+	return results
+}
+
+// cronSchedule is a parsed schedule expression: bit sets of the minutes,
+// hours, days of the month, months and days of the week it allows.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set when the day fields start with *. As in
+	// cron, when both are restricted a day matching either is allowed.
+	domAny, dowAny bool
+}
+
+// cronFields are the fields of a schedule expression and their ranges. Day
+// of the week 0 and 7 are both Sunday.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseSchedule parses a five-field cron expression: minute, hour, day of
+// the month, month and day of the week. Each field is *, a number, a range
+// such as 9-17, any of those with a step such as */15, or a comma-separated
+// list of them. Names of months and days are not supported.
+func parseSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("want 5 fields (minute hour day-of-month month day-of-week), got %d", len(fields))
+	}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", cronFields[i].name, err)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSchedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField returns the set of values between first and last allowed by
+// one field of a schedule expression.
+func parseCronField(field string, first, last int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		span, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+		lo, hi := first, last
+		if span != "*" {
+			from, to, isRange := strings.Cut(span, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if hasStep {
+				hi = last
+			}
+			if lo < first || hi > last || lo > hi {
+				return 0, fmt.Errorf("%q is outside %d-%d", part, first, last)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether the schedule allows checking at t.
+func (c *cronSchedule) matches(t time.Time) bool {
+	has := func(set uint64, v int) bool { return set&(1<<v) != 0 }
+	if !has(c.minute, t.Minute()) || !has(c.hour, t.Hour()) || !has(c.month, int(t.Month())) {
+		return false
+	}
+	dom, dow := has(c.dom, t.Day()), has(c.dow, int(t.Weekday()))
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// processFeedWithin runs processFeed, giving up on it after the feed's
+// process_timeout. The check works on a copy of the feed's state, which
+// replaces the feed's own only if the check finishes in time. A check given
+// up on has its requests cancelled but may take a while to wind down; its
+// result is dropped, and the feed is skipped until it has.
+func processFeedWithin(feed *Feed, client *http.Client) FeedResult {
+	if feed.ProcessTimeout <= 0 {
+		return processFeed(feed, client)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), feed.ProcessTimeout)
+	defer cancel()
+
+	work := checkCopy(feed)
+	done := make(chan FeedResult, 1)
+	statsMu.Lock()
+	feed.processing = true
+	statsMu.Unlock()
+	go func() {
+		result := processFeedContext(ctx, work, client)
+		statsMu.Lock()
+		feed.processing = false
+		statsMu.Unlock()
+		done <- result
+	}()
+
+	select {
+	case result := <-done:
+		if ctx.Err() == nil {
+			commitCheck(feed, work)
+			return result
+		}
+	case <-ctx.Done():
+	}
+	return FeedResult{URL: feed.URL, Err: fmt.Errorf("%w: check timed out after process_timeout of %v, abandoning it", ErrFetch, feed.ProcessTimeout)}
+}
+
+// checkCopy returns a copy of feed for a check to work on, sharing none of
+// the state the check changes.
+func checkCopy(feed *Feed) *Feed {
+	work := *feed
+	if feed.seen != nil {
+		work.seen = &bloomFilter{Bits: slices.Clone(feed.seen.Bits), Hashes: feed.seen.Hashes}
+	}
+	if feed.hashes != nil {
+		work.hashes = &hashSet{keys: slices.Clone(feed.hashes.keys), index: maps.Clone(feed.hashes.index)}
+	}
+	work.present = slices.Clone(feed.present)
+	work.held = slices.Clone(feed.held)
+	work.clamped = maps.Clone(feed.clamped)
+	work.itemHashes = maps.Clone(feed.itemHashes)
+	return &work
+}
+
+// commitCheck copies the state a finished check left in work, a checkCopy of
+// feed, back onto feed. The feed's bloom filter and hash set are updated in
+// place, as the other feeds of its dedup group share them.
+func commitCheck(feed, work *Feed) {
+	switch {
+	case work.seen == nil:
+	case feed.seen == nil:
+		feed.seen = work.seen
+	default:
+		*feed.seen = *work.seen
+	}
+	switch {
+	case work.hashes == nil:
+	case feed.hashes == nil:
+		feed.hashes = work.hashes
+	default:
+		*feed.hashes = *work.hashes
+	}
+	feed.LastUpdate = work.LastUpdate
+	feed.primed = work.primed
+	feed.jar = work.jar
+	feed.itemCount = work.itemCount
+	feed.present = work.present
+	feed.held = work.held
+	feed.lastNotified = work.lastNotified
+	feed.clamped = work.clamped
+	feed.itemHashes = work.itemHashes
+}
+
+// staggerFirstPolls makes the first poll of each feed that has never been
+// polled due at a random time within its interval, so a long feed list isn't
+// all fetched at once on startup.
+func staggerFirstPolls(feeds []Feed) {
+	now := clock.Now()
+	for i := range feeds {
+		feed := &feeds[i]
+		if !feed.lastPoll.IsZero() || feed.interval <= 0 {
+			continue
+		}
+		feed.lastPoll = now.Add(rand.N(feed.interval) - feed.interval)
+	}
+}
+
+// nextSleep returns how long to sleep before the next check: tick, or less
+// if a feed is due sooner.
+func nextSleep(feeds []Feed, tick time.Duration) time.Duration {
+	now := clock.Now()
+	sleep := tick
+	for _, feed := range feeds {
+		if feed.interval <= 0 || feed.lastPoll.IsZero() {
+			continue
+		}
+		if until := feed.lastPoll.Add(feed.interval).Sub(now); until > 0 && until < sleep {
+			sleep = until
+		}
+	}
+	return sleep
+}
+
+// batchFeeds splits feeds into batches that are processed one after another
+// in a single goroutine. Feeds in the same dedup group share state and feeds
+// in the same host group must not be fetched at once, so each such group
+// ends up in one batch. Every other feed gets a batch of its own.
+func batchFeeds(feeds []*Feed) [][]*Feed {
+	var batches [][]*Feed
+	batchOf := map[string]int{}
+	for _, feed := range feeds {
+		var keys []string
+		if feed.DedupGroup != "" {
+			keys = append(keys, "dedup:"+feed.DedupGroup)
+		}
+		if group := hostGroup(feed); group != "" {
+			keys = append(keys, "host:"+group)
+		}
+
+		target := -1
+		for _, key := range keys {
+			j, ok := batchOf[key]
+			if !ok || j == target {
+				continue
+			}
+			if target == -1 {
+				target = j
+				continue
+			}
+			// The feed joins two batches, which become one.
+			batches[target] = append(batches[target], batches[j]...)
+			batches[j] = nil
+			for k, b := range batchOf {
+				if b == j {
+					batchOf[k] = target
+				}
+			}
+		}
+		if target == -1 {
+			target = len(batches)
+			batches = append(batches, nil)
+		}
+		batches[target] = append(batches[target], feed)
+		for _, key := range keys {
+			batchOf[key] = target
+		}
+	}
+
+	nonEmpty := batches[:0]
+	for _, batch := range batches {
+		if len(batch) > 0 {
+			nonEmpty = append(nonEmpty, batch)
+		}
+	}
+	return nonEmpty
+}
+
+// hostGroup returns the host group of feed, resolving "auto" to the host of
+// its URL.
+func hostGroup(feed *Feed) string {
+	if feed.HostGroup != "auto" {
+		return feed.HostGroup
+	}
+	u, err := url.Parse(feed.URL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// statsMu guards the fields of each feed updated by recordResult, which
+// logStats reads while feeds are being checked.
+var statsMu sync.Mutex
+
+// recordResult updates the feed's statistics with the result of a check.
+func recordResult(feed *Feed, result FeedResult) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	feed.notified += result.Notified
+	if result.Err != nil {
+		if feed.failures == 0 {
+			feed.failingSince = clock.Now()
+		}
+		feed.failures++
+		return
+	}
+	feed.failures = 0
+	feed.failingSince = time.Time{}
+	feed.lastSuccess = clock.Now()
+}
+
+// recovering reports whether feed has quiet_recovery and has been failing
+// for longer than its interval, so that the check now succeeding catches up
+// like a first check instead of notifying the items of the whole outage.
+func recovering(feed *Feed) bool {
+	if !feed.QuietRecovery {
+		return false
+	}
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	return feed.failures > 0 && clock.Now().Sub(feed.failingSince) > feed.interval
+}
+
+// catchUp makes the next poll of feed behave like its first: items already
+// in the feed are recorded as seen, and only those within bootstrap_since
+// are notified.
+func catchUp(feed *Feed) {
+	feed.primed = false
+	if since := clock.Now().Add(-feed.BootstrapSince); since.After(feed.LastUpdate) {
+		feed.LastUpdate = since
+	}
+}
+
+// logStats logs the uptime and each feed's last successful check,
+// consecutive failures and notifications sent, when asked for with
+// SIGUSR1.
+func logStats(feeds []Feed, started time.Time) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	log.Infof("Up for %v, checking %d feeds", clock.Now().Sub(started).Round(time.Second), len(feeds))
+	for _, feed := range feeds {
+		lastSuccess := "never"
+		if !feed.lastSuccess.IsZero() {
+			lastSuccess = feed.lastSuccess.UTC().Format(time.RFC3339)
+		}
+		log.WithFields(log.Fields{
+			"feed":                 feed.URL,
+			"last_success":         lastSuccess,
+			"consecutive_failures": feed.failures,
+			"notified":             feed.notified,
+		}).Info("Feed stats")
+	}
+}
+
+// scheduleFeeds sets how often each feed is due: its group's interval, or the
+// check interval for feeds without a group. It returns the shortest of those,
+// which is how long the main loop sleeps between checks.
+func scheduleFeeds(feeds []Feed, groups map[string]time.Duration, interval time.Duration) time.Duration {
+	tick := interval
+	for i := range feeds {
+		feeds[i].interval = interval
+		if groupInterval, ok := groups[feeds[i].Group]; ok {
+			feeds[i].interval = groupInterval
+		}
+		if feeds[i].interval < tick {
+			tick = feeds[i].interval
+		}
+	}
+	return tick
+}
+
+// startupRetryDelays are the waits before rechecking feeds whose first check
+// failed with a network error, so a network that is still coming up after a
+// reboot doesn't hold back notifications for a whole interval.
+var startupRetryDelays = []time.Duration{5 * time.Second, 15 * time.Second, 30 * time.Second, time.Minute}
+
+// retryNetworkFailures rechecks the feeds of results that failed with a DNS
+// or connection error, after each of startupRetryDelays in turn, until they
+// either succeed or fail for another reason.
+func retryNetworkFailures(feeds []Feed, results []FeedResult, client *http.Client) {
+	failed := map[string]bool{}
+	for _, result := range results {
+		if isNetworkError(result.Err) {
+			failed[result.URL] = true
+		}
+	}
+
+	for _, delay := range startupRetryDelays {
+		if len(failed) == 0 {
+			return
+		}
+		log.Infof("Retrying %d feeds that failed with network errors in %v", len(failed), delay)
+		clock.Sleep(delay)
+
+		for i := range feeds {
+			feed := &feeds[i]
+			if !failed[feed.URL] {
+				continue
+			}
+			if feed.DedupGroup != "" {
+				var members []*Feed
+				for j := range feeds {
+					if feeds[j].DedupGroup == feed.DedupGroup {
+						members = append(members, &feeds[j])
+					}
+				}
+				syncDedupGroup(feed, members)
+			}
+			result := processFeed(feed, client)
+			recordResult(feed, result)
+			if isNetworkError(result.Err) {
+				continue
+			}
+			delete(failed, feed.URL)
+			if result.Err != nil {
+				log.WithField("feed", feed.URL).Errorf("Error processing feed: %v", result.Err)
+			}
+		}
+	}
+}
+
+// isNetworkError reports whether err is a fetch that failed to resolve the
+// feed's host or to connect to it.
+func isNetworkError(err error) bool {
+	if !errors.Is(err, ErrFetch) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	return errors.As(err, &dnsErr) || errors.As(err, &opErr)
+}
+
+// syncDedupGroup brings feed up to date with the seen-item state of the
+// other feeds in its dedup group before it is processed. The group's bloom
+// filter is the first member's, which every other member adopts, so filters
+// restored separately from the state file converge on one shared filter.
+func syncDedupGroup(feed *Feed, members []*Feed) {
+	var shared *bloomFilter
+	var sharedHashes *hashSet
+	for _, member := range members {
+		if member.LastUpdate.After(feed.LastUpdate) {
+			feed.LastUpdate = member.LastUpdate
+		}
+		if shared == nil {
+			shared = member.seen
+		}
+		if sharedHashes == nil {
+			sharedHashes = member.hashes
+		}
+		feed.primed = feed.primed || member.primed
+	}
+	if shared != nil {
+		feed.seen = shared
+	}
+	if sharedHashes != nil {
+		feed.hashes = sharedHashes
+	}
+}
+
+func loadConfig(filename string) (*Config, error) {
+	data, remote, err := readConfigFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// Strict unmarshalling rejects unknown keys, so a typo such as
+	// "ntfy_topics" is reported instead of silently ignored.
+	var config Config
+	err = yaml.UnmarshalStrict(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file: %w", err)
+	}
+
+	if err := validateDefaults(data); err != nil {
+		return nil, fmt.Errorf("error parsing config file: %w", err)
+	}
+	config.Defaults, err = withEnvDefaults(config.Defaults)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Defaults) > 0 {
+		if err := applyDefaults(data, &config); err != nil {
+			return nil, fmt.Errorf("error parsing config file: %w", err)
+		}
+	}
+
+	config.tlsMinVersion, err = parseTLSVersion(config.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	if config.IPPreference != "" && config.IPPreference != "ipv4" && config.IPPreference != "ipv6" {
+		return nil, fmt.Errorf("ip_preference must be ipv4 or ipv6")
+	}
+	if config.FallbackDelay < 0 {
+		return nil, fmt.Errorf("fallback_delay must not be negative")
+	}
+	config.displayLocation, err = time.LoadLocation(config.DisplayTimezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid display_timezone: %w", err)
+	}
+	if config.Tor.Proxy != "" {
+		u, err := url.Parse(config.Tor.Proxy)
+		if err != nil || (u.Scheme != "socks5" && u.Scheme != "socks5h") || u.Host == "" {
+			return nil, fmt.Errorf("tor.proxy must be a socks5:// URL such as socks5://127.0.0.1:9050")
+		}
+	}
+	if config.Tor.Timeout < 0 {
+		return nil, fmt.Errorf("tor.timeout must not be negative")
+	}
+
+	if r := config.NotifyRetry; r.Attempts < 0 || r.Backoff < 0 || r.Redeliveries < 0 {
+		return nil, fmt.Errorf("notify_retry settings must not be negative")
+	}
+	if config.NotifyWorkers < 0 {
+		return nil, fmt.Errorf("notify_workers must not be negative")
+	}
+	for name, interval := range config.Groups {
+		if interval <= 0 {
+			return nil, fmt.Errorf("group %q: interval must be positive", name)
+		}
+	}
+
+	if config.ErrorTopic != "" {
+		topic, err := normalizeTopic(qualifyTopic(config.ErrorTopic))
+		if err != nil {
+			return nil, fmt.Errorf("error_topic: %w", err)
+		}
+		config.ErrorTopic = topic
+	}
+
+	for i, route := range config.Routes {
+		if route.NtfyTopic == "" {
+			return nil, fmt.Errorf("route %d: ntfy_topic is required", i+1)
+		}
+		topic, err := normalizeTopic(qualifyTopic(route.NtfyTopic))
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %w", i+1, err)
+		}
+		config.Routes[i].NtfyTopic = topic
+		if route.Label == "" && route.URL == "" {
+			return nil, fmt.Errorf("route %d: label or url is required", i+1)
+		}
+		for _, pattern := range []string{route.Label, route.URL} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("route %d: invalid pattern %q: %w", i+1, pattern, err)
+			}
+		}
+	}
+
+	for i := range config.Feeds {
+		feed := &config.Feeds[i]
+		if len(feed.CategoryTopics) == 0 {
+			continue
+		}
+		topics := map[string]string{}
+		for category, categoryTopic := range feed.CategoryTopics {
+			topic, err := normalizeTopic(qualifyTopic(categoryTopic))
+			if err != nil {
+				return nil, fmt.Errorf("feed %s: category %q: %w", feed.URL, category, err)
+			}
+			topics[strings.ToLower(category)] = topic
+		}
+		feed.CategoryTopics = topics
+	}
+
+	for i := range config.Feeds {
+		if config.Feeds[i].NtfyTopic == "" {
+			continue
+		}
+		topic, err := normalizeTopic(qualifyTopic(config.Feeds[i].NtfyTopic))
+		if err != nil {
+			return nil, fmt.Errorf("feed %s: %w", config.Feeds[i].URL, err)
+		}
+		config.Feeds[i].NtfyTopic = topic
+	}
+
+	for i := range config.Feeds {
+		feed := &config.Feeds[i]
+		if feed.Importance != "" {
+			priority, ok := importancePriorities[feed.Importance]
+			if !ok {
+				return nil, fmt.Errorf("feed %s: importance must be low, default, high or urgent", feed.URL)
+			}
+			if feed.Priority == 0 {
+				feed.Priority = priority
+			}
+		}
+		if feed.Schedule != "" {
+			schedule, err := parseSchedule(feed.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("feed %s: schedule: %w", feed.URL, err)
+			}
+			feed.schedule = schedule
+		}
+		if feed.Filter != nil {
+			if err := feed.Filter.compile(); err != nil {
+				return nil, fmt.Errorf("feed %s: filter: %w", feed.URL, err)
+			}
+		}
+	}
+
+	groupModes := map[string]string{}
+	for _, feed := range config.Feeds {
+		if feed.NtfyTopic == "" && routeTopic(config.Routes, &feed) == "" {
+			return nil, fmt.Errorf("feed %s: ntfy_topic is required unless a route matches the feed", feed.URL)
+		}
+		if err := validatePriority(feed.Priority); err != nil {
+			return nil, fmt.Errorf("feed %s: %w", feed.URL, err)
+		}
+		if feed.Email != "" {
+			if _, err := mail.ParseAddress(feed.Email); err != nil {
+				return nil, fmt.Errorf("feed %s: invalid email %q: %w", feed.URL, feed.Email, err)
+			}
+		}
+		if feed.Call != "" && feed.Call != "yes" && !phoneNumberPattern.MatchString(feed.Call) {
+			return nil, fmt.Errorf("feed %s: call must be \"yes\" or a phone number like +12223334444", feed.URL)
+		}
+		if err := validatePriority(feed.CallMinPriority); err != nil {
+			return nil, fmt.Errorf("feed %s: call_min_priority: %w", feed.URL, err)
+		}
+		if err := validateActions(feed.Actions); err != nil {
+			return nil, fmt.Errorf("feed %s: %w", feed.URL, err)
+		}
+		if err := validateExec(feed.Exec); err != nil {
+			return nil, fmt.Errorf("feed %s: %w", feed.URL, err)
+		}
+		if _, err := parseMatch(feed.Match); err != nil {
+			return nil, fmt.Errorf("feed %s: match: %w", feed.URL, err)
+		}
+		for j, rule := range feed.Rules {
+			if len(rule.Keywords) == 0 && rule.Match == "" {
+				return nil, fmt.Errorf("feed %s: rule %d: keywords or match is required", feed.URL, j+1)
+			}
+			if _, err := parseMatch(rule.Match); err != nil {
+				return nil, fmt.Errorf("feed %s: rule %d: match: %w", feed.URL, j+1, err)
+			}
+			if err := validatePriority(rule.Priority); err != nil {
+				return nil, fmt.Errorf("feed %s: rule %d: %w", feed.URL, j+1, err)
+			}
+			if _, err := template.New("message_template").Funcs(templateFuncs).Parse(rule.MessageTemplate); err != nil {
+				return nil, fmt.Errorf("feed %s: rule %d: invalid message_template: %w", feed.URL, j+1, err)
+			}
+		}
+		if feed.AlertOnEmpty && config.ErrorTopic == "" {
+			return nil, fmt.Errorf("feed %s: alert_on_empty needs error_topic to be set", feed.URL)
+		}
+		if feed.Login != nil {
+			if u, err := url.Parse(feed.Login.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("feed %s: login: url must be an http or https URL", feed.URL)
+			}
+		}
+		if _, err := template.New("group_key").Funcs(templateFuncs).Parse(feed.GroupKey); err != nil {
+			return nil, fmt.Errorf("feed %s: group_key: %w", feed.URL, err)
+		}
+		for _, tag := range feed.Tags {
+			if _, err := template.New("tags").Funcs(templateFuncs).Parse(tag); err != nil {
+				return nil, fmt.Errorf("feed %s: tags: %w", feed.URL, err)
+			}
+		}
+		for keyword, priority := range feed.PriorityKeywords {
+			if err := validatePriority(priority); err != nil {
+				return nil, fmt.Errorf("feed %s: keyword %q: %w", feed.URL, keyword, err)
+			}
+		}
+		switch feed.Format {
+		case "", "auto", "rss", "atom", "json", "hfeed":
+		default:
+			return nil, fmt.Errorf("feed %s: unknown format %q", feed.URL, feed.Format)
+		}
+		if feed.MaxBody < 0 {
+			return nil, fmt.Errorf("feed %s: max_body must not be negative", feed.URL)
+		}
+		if _, ok := splitters[feed.Splitter]; feed.Splitter != "" && !ok {
+			return nil, fmt.Errorf("feed %s: unknown splitter %q", feed.URL, feed.Splitter)
+		}
+		switch feed.LinkPosition {
+		case "", "before", "after":
+		default:
+			return nil, fmt.Errorf("feed %s: link_position must be before or after", feed.URL)
+		}
+		for _, field := range feed.DateFields {
+			if !slices.Contains(dateFieldNames, field) {
+				return nil, fmt.Errorf("feed %s: date_fields: unknown field %q (want pubDate, published, dc:date or updated)", feed.URL, field)
+			}
+		}
+		switch feed.FutureDates {
+		case "", "keep", "clamp", "skip":
+		default:
+			return nil, fmt.Errorf("feed %s: future_dates must be keep, clamp or skip", feed.URL)
+		}
+		switch feed.DedupMode {
+		case "", "timestamp", "bloom", "hash":
+		default:
+			return nil, fmt.Errorf("feed %s: unknown dedup_mode %q", feed.URL, feed.DedupMode)
+		}
+		if feed.BloomFalsePositiveRate < 0 || feed.BloomFalsePositiveRate >= 1 {
+			return nil, fmt.Errorf("feed %s: bloom_false_positive_rate must be between 0 and 1", feed.URL)
+		}
+		if feed.MinInterval < 0 {
+			return nil, fmt.Errorf("feed %s: min_interval must not be negative", feed.URL)
+		}
+		if feed.DedupGroup != "" {
+			// An empty dedup_mode means "timestamp", so the two must not be
+			// reported as a mismatch.
+			mode := firstNonEmpty(feed.DedupMode, "timestamp")
+			if groupMode, ok := groupModes[feed.DedupGroup]; ok && groupMode != mode {
+				return nil, fmt.Errorf("feed %s: all feeds in dedup_group %q must use the same dedup_mode", feed.URL, feed.DedupGroup)
+			}
+			groupModes[feed.DedupGroup] = mode
+		}
+		if feed.BootstrapSince < 0 {
+			return nil, fmt.Errorf("feed %s: bootstrap_since must not be negative", feed.URL)
+		}
+		if (feed.APIKeyParam == "") != (feed.APIKey == "") {
+			return nil, fmt.Errorf("feed %s: api_key_param and api_key must be set together", feed.URL)
+		}
+		if feed.FetchTimeout < 0 || feed.NotifyTimeout < 0 || feed.ProcessTimeout < 0 {
+			return nil, fmt.Errorf("feed %s: fetch_timeout and notify_timeout must not be negative", feed.URL)
+		}
+		if feed.MaxItemAge < 0 {
+			return nil, fmt.Errorf("feed %s: max_item_age must not be negative", feed.URL)
+		}
+		if _, ok := config.Groups[feed.Group]; feed.Group != "" && !ok {
+			return nil, fmt.Errorf("feed %s: group %q is not defined in groups", feed.URL, feed.Group)
+		}
+		if usesTor(&feed) && config.Tor.Proxy == "" {
+			return nil, fmt.Errorf("feed %s: fetching through Tor requires tor.proxy to be set", feed.URL)
+		}
+	}
+
+	now := clock.Now()
+	for i := range config.Feeds {
+		config.Feeds[i].LastUpdate = now.Add(-config.Feeds[i].BootstrapSince)
+	}
+
+	if remote && configCacheFile != "" {
+		if err := writeFileAtomic(expandTilde(configCacheFile), data); err != nil {
+			log.Errorf("Error writing config cache: %v", err)
+		}
+	}
+	return &config, nil
+}
+
+// configCacheFile is the -config-cache file keeping the last good copy of a
+// config fetched over HTTP.
+var configCacheFile string
+
+// readConfigFile returns the contents of the config file, fetching it when
+// filename is an https URL. If the fetch fails, the copy in configCacheFile
+// is used instead; remote is then false, as it is for a local file. A config
+// can run commands through exec hooks and read local files through file://
+// feeds, so it is never fetched over plain http.
+func readConfigFile(filename string) (data []byte, remote bool, err error) {
+	if strings.HasPrefix(filename, "http://") {
+		return nil, false, fmt.Errorf("config URL %s must use https", redactURL(filename))
+	}
+	if !strings.HasPrefix(filename, "https://") {
+		filename = expandTilde(filename)
+		data, err := os.ReadFile(filename)
+		if os.IsNotExist(err) {
+			return nil, false, fmt.Errorf("config file %s does not exist", filename)
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("error reading config file: %w", err)
+		}
+		return data, false, nil
+	}
+
+	data, err = fetchConfig(filename)
+	if err == nil {
+		return data, true, nil
+	}
+	if configCacheFile == "" {
+		return nil, false, err
+	}
+	cached, cacheErr := os.ReadFile(expandTilde(configCacheFile))
+	if cacheErr != nil {
+		return nil, false, err
+	}
+	log.Warnf("Using cached config from %s: %v", configCacheFile, err)
+	return cached, false, nil
+}
+
+// configClient fetches remote config files. It refuses redirects away from
+// https.
+var configClient = &http.Client{
+	Timeout:   time.Second * 30,
+	Transport: newTransport(tls.VersionTLS12),
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("refusing redirect of the config file to %s, which isn't https", redactURL(req.URL.String()))
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	},
+}
+
+// fetchConfig downloads a config file served over https.
+func fetchConfig(configURL string) ([]byte, error) {
+	resp, err := configClient.Get(configURL)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			urlErr.URL = redactURL(configURL)
+		}
+		return nil, fmt.Errorf("error fetching config file: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching config file: %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+	return data, nil
+}
+
+// parseTLSVersion converts a tls_min_version value such as "1.3" to its
+// crypto/tls constant. An empty value means TLS 1.2.
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("tls_min_version must be one of 1.0, 1.1, 1.2 or 1.3, got %q", version)
+}
+
+// usesTor reports whether feed is fetched through the Tor proxy.
+func usesTor(feed *Feed) bool {
+	if feed.Tor {
+		return true
+	}
+	u, err := url.Parse(feed.URL)
+	return err == nil && strings.HasSuffix(u.Hostname(), ".onion")
+}
+
+// clientFor returns the client feed is fetched with: torClient for feeds that
+// go through Tor, client otherwise.
+func clientFor(feed *Feed, client *http.Client) *http.Client {
+	if torClient != nil && usesTor(feed) {
+		return torClient
+	}
+	return client
+}
+
+// withTimeout returns a copy of client with the given timeout, or client
+// itself when timeout is zero.
+func withTimeout(client *http.Client, timeout time.Duration) *http.Client {
+	if timeout == 0 {
+		return client
+	}
+	c := *client
+	c.Timeout = timeout
+	return &c
+}
+
+// newTransport returns a copy of the default HTTP transport that refuses TLS
+// versions below minVersion and connects with dialContext.
+func newTransport(minVersion uint16) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: minVersion}
+	transport.DialContext = dialContext
+	return transport
+}
+
+// dialer makes the connections of the transports from newTransport, with
+// the settings of http.DefaultTransport. Its FallbackDelay is the config's
+// fallback_delay.
+var dialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+// ipPreference is the config's ip_preference, "ipv4", "ipv6" or "".
+var ipPreference string
+
+// dialContext connects to addr with dialer. With an ipPreference, it first
+// tries only addresses of that family, so a host whose other family is
+// unreachable doesn't stall every connection, and then any address, for
+// hosts that have none of the preferred family.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if ipPreference == "" || network != "tcp" {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	preferred := "tcp4"
+	if ipPreference == "ipv6" {
+		preferred = "tcp6"
+	}
+	conn, err := dialer.DialContext(ctx, preferred, addr)
+	if err == nil || ctx.Err() != nil {
+		return conn, err
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// Environment variables providing defaults for a deployment without config
+// file changes, such as a Docker container.
+const (
+	envDefaultServer   = "NTFY_DEFAULT_SERVER"
+	envDefaultTopic    = "NTFY_DEFAULT_TOPIC"
+	envDefaultToken    = "NTFY_DEFAULT_TOKEN"
+	envDefaultPriority = "NTFY_DEFAULT_PRIORITY"
+)
+
+// withEnvDefaults adds NTFY_DEFAULT_TOPIC and NTFY_DEFAULT_PRIORITY to the
+// defaults block, unless it already sets those keys.
+func withEnvDefaults(defaults yaml.MapSlice) (yaml.MapSlice, error) {
+	if topic := os.Getenv(envDefaultTopic); topic != "" && !hasKey(defaults, "ntfy_topic") {
+		defaults = append(defaults, yaml.MapItem{Key: "ntfy_topic", Value: topic})
+	}
+	if value := os.Getenv(envDefaultPriority); value != "" && !hasKey(defaults, "priority") {
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envDefaultPriority, err)
+		}
+		if err := validatePriority(priority); err != nil {
+			return nil, fmt.Errorf("%s: %w", envDefaultPriority, err)
+		}
+		defaults = append(defaults, yaml.MapItem{Key: "priority", Value: priority})
+	}
+	return defaults, nil
+}
+
+// qualifyTopic turns a bare topic name such as "alerts" into a topic URL on
+// NTFY_DEFAULT_SERVER, when that is set. Other topics are returned as is.
+func qualifyTopic(topic string) string {
+	server := strings.TrimRight(os.Getenv(envDefaultServer), "/")
+	topic = strings.TrimSpace(topic)
+	if server == "" || strings.Contains(topic, "://") {
+		return topic
+	}
+	return server + "/" + strings.TrimLeft(topic, "/")
+}
+
+// addEnvToken adds NTFY_DEFAULT_TOKEN to tokens as the credential for
+// NTFY_DEFAULT_SERVER, unless the auth file already has one for the server.
+func addEnvToken(tokens map[string]string) error {
+	token := strings.TrimSpace(os.Getenv(envDefaultToken))
+	if token == "" {
+		return nil
+	}
+	server := os.Getenv(envDefaultServer)
+	u, err := url.Parse(server)
+	if server == "" || err != nil || u.Host == "" {
+		return fmt.Errorf("%s requires %s to be set to a server URL", envDefaultToken, envDefaultServer)
+	}
+	if _, ok := tokens[serverOf(server)]; !ok {
+		tokens[serverOf(server)] = token
+	}
+	return nil
+}
+
+// normalizeTopic trims whitespace from an ntfy topic URL, checks that it is
+// an http(s) URL with a host and a topic, and percent-encodes its path so
+// characters such as spaces are sent correctly.
+func normalizeTopic(topic string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(topic))
+	if err != nil {
+		return "", fmt.Errorf("invalid ntfy_topic %q: %w", topic, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid ntfy_topic %q: scheme must be http or https", topic)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid ntfy_topic %q: missing host", topic)
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		return "", fmt.Errorf("invalid ntfy_topic %q: missing topic name", topic)
+	}
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// validateDefaults strictly decodes the defaults block of the original
+// document as a feed, so a mistyped key is reported with its line number even
+// when no feed would pick it up. The rest of the document has already been
+// checked by the Config decode and is skipped here.
+func validateDefaults(data []byte) error {
+	var check struct {
+		Defaults Feed                   `yaml:"defaults"`
+		Rest     map[string]interface{} `yaml:",inline"`
+	}
+	return yaml.UnmarshalStrict(data, &check)
+}
+
+// yamlLinePrefix matches the "line N: " prefix yaml.v2 puts on decode errors.
+var yamlLinePrefix = regexp.MustCompile(`^line \d+: `)
+
+// withoutLineNumbers strips line numbers from a yaml decode error. It is used
+// for documents built in memory, whose line numbers don't match the config
+// file.
+func withoutLineNumbers(err error) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return err
+	}
+	msgs := make([]string, len(typeErr.Errors))
+	for i, msg := range typeErr.Errors {
+		msgs[i] = yamlLinePrefix.ReplaceAllString(msg, "")
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// applyDefaults rebuilds config.Feeds with the defaults block merged into
+// each feed. Merging happens on the raw YAML keys, so a default only applies
+// when the feed omits the key entirely and an explicit zero value (such as
+// "priority: 0" or "labels: []") on the feed still takes precedence. A feed
+// value replaces the default value as a whole, including for lists and maps.
+func applyDefaults(data []byte, config *Config) error {
+	for _, item := range config.Defaults {
+		if fmt.Sprint(item.Key) == "url" {
+			return fmt.Errorf("defaults: url cannot have a default")
+		}
+	}
+
+	var raw struct {
+		Feeds []yaml.MapSlice `yaml:"feeds"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	for i, feedMap := range raw.Feeds {
+		merged := append(yaml.MapSlice{}, feedMap...)
+		for _, item := range config.Defaults {
+			if !hasKey(feedMap, item.Key) {
+				merged = append(merged, item)
+			}
+		}
+
+		out, err := yaml.Marshal(merged)
+		if err != nil {
+			return err
+		}
+		var feed Feed
+		if err := yaml.UnmarshalStrict(out, &feed); err != nil {
+			return fmt.Errorf("feed %d (%v) with defaults: %w", i+1, feedURL(feedMap), withoutLineNumbers(err))
+		}
+		config.Feeds[i] = feed
+	}
+	return nil
+}
+
+// feedURL returns the url key of a raw feed, or "no url" if it has none.
+func feedURL(m yaml.MapSlice) interface{} {
+	for _, item := range m {
+		if fmt.Sprint(item.Key) == "url" {
+			return item.Value
+		}
+	}
+	return "no url"
+}
+
+func hasKey(m yaml.MapSlice, key interface{}) bool {
+	for _, item := range m {
+		if fmt.Sprint(item.Key) == fmt.Sprint(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadState reads the state file, returning empty state if it does not exist
+// yet.
+func loadState(filename string) (*State, error) {
+	data, err := os.ReadFile(expandTilde(filename))
+	if os.IsNotExist(err) {
+		return &State{Feeds: map[string]*FeedState{}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %w", err)
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error parsing state file: %w", err)
+	}
+	if state.Feeds == nil {
+		state.Feeds = map[string]*FeedState{}
+	}
+	return &state, nil
+}
+
+// applyState restores persisted state onto the configured feeds. Feeds with
+// no saved state keep the defaults set by loadConfig.
+func applyState(feeds []Feed, state *State) {
+	for i := range feeds {
+		feed := &feeds[i]
+		fs, ok := state.Feeds[feed.URL]
+		if !ok {
+			continue
+		}
+		if !fs.LastUpdate.IsZero() {
+			feed.LastUpdate = fs.LastUpdate
+		}
+		feed.lastPoll = fs.LastPoll
+		if feed.DedupMode == "bloom" && fs.Bloom != nil {
+			expected := newFeedBloomFilter(feed)
+			switch {
+			case len(fs.Bloom.Bits) == 0 || fs.Bloom.Hashes <= 0:
+				log.WithField("feed", feed.URL).Warn("Saved bloom filter is invalid, starting a new one")
+			case len(fs.Bloom.Bits) != len(expected.Bits) || fs.Bloom.Hashes != expected.Hashes:
+				log.WithField("feed", feed.URL).Warn("Saved bloom filter doesn't match bloom_capacity and bloom_false_positive_rate, starting a new one")
+			default:
+				feed.seen = fs.Bloom
+				feed.primed = true
+			}
+		}
+		if feed.DedupMode == "hash" && len(fs.Hashes) > 0 {
+			feed.hashes = newHashSet(fs.Hashes)
+			feed.primed = true
+		}
+		if feed.NotifyOnRemoval {
+			feed.present = fs.Present
+		}
+		if feed.Throttle > 0 {
+			feed.lastNotified = fs.LastNotified
+			feed.held = fs.Held
+		}
+		if feed.FutureDates == "clamp" {
+			feed.clamped = fs.Clamped
+		}
+		if feed.NotifyOnContentChange {
+			feed.itemHashes = fs.ItemHashes
+		}
+		feed.itemCount = fs.ItemCount
+	}
+}
+
+// saveState writes the feeds' state and the pending notifications of the
+// outbox to filename, replacing it atomically so a crash mid-write never
+// leaves a truncated file behind.
+func saveState(filename string, feeds []Feed, pending []Notification) error {
+	state := feedStates(feeds)
+	state.Pending = pending
+	return writeState(filename, state)
+}
+
+// feedStates returns the state of the feeds as saved to the state file.
+func feedStates(feeds []Feed) *State {
+	state := State{Feeds: map[string]*FeedState{}}
+	for _, feed := range feeds {
+		state.Feeds[feed.URL] = &FeedState{
+			LastUpdate: feed.LastUpdate,
+			LastPoll:   feed.lastPoll,
+			Bloom:      feed.seen,
+			Hashes:     feed.hashes.list(),
+			Present:    feed.present,
+
+			LastNotified: feed.lastNotified,
+			Held:         feed.held,
+			Clamped:      feed.clamped,
+			ItemHashes:   feed.itemHashes,
+			ItemCount:    feed.itemCount,
+		}
+	}
+	return &state
+}
+
+// reloadConfig loads the config file again for a SIGHUP. The feeds that
+// were already running keep their state and statistics. If the new config
+// doesn't load or has no feeds, the error is returned and the running
+// config left alone.
+func reloadConfig(configFile string, running *Config) (*Config, error) {
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Feeds) == 0 {
+		return nil, fmt.Errorf("config file %s has no feeds", configFile)
+	}
+
+	applyState(config.Feeds, feedStates(running.Feeds))
+	old := map[string]*Feed{}
+	for i := range running.Feeds {
+		old[running.Feeds[i].URL] = &running.Feeds[i]
+	}
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	for i := range config.Feeds {
+		if o, ok := old[config.Feeds[i].URL]; ok {
+			config.Feeds[i].lastSuccess = o.lastSuccess
+			config.Feeds[i].failures = o.failures
+			config.Feeds[i].failingSince = o.failingSince
+			config.Feeds[i].notified = o.notified
+		}
+	}
+	return config, nil
+}
+
+// reportError notifies errorTopic, if set, of a problem with rss-to-ntfy
+// itself or one of its feeds rather than of a feed item.
+func reportError(title, body string) {
+	if errorTopic == "" {
+		return
+	}
+	n := Notification{
+		Topic:    errorTopic,
+		Title:    "rss-to-ntfy: " + title,
+		Body:     markdownEscape(body),
+		Priority: 4,
+		Tags:     "warning",
+	}
+	if err := notify(context.Background(), n, log.WithField("topic", errorTopic)); err != nil {
+		log.Errorf("Error notifying error_topic: %v", err)
+	}
+}
+
+// pruneState removes the saved state of feeds that are no longer configured
+// from the state file and returns their URLs, sorted.
+func pruneState(filename string, feeds []Feed) ([]string, error) {
+	state, err := loadState(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	configured := map[string]bool{}
+	for _, feed := range feeds {
+		configured[feed.URL] = true
+	}
+	var removed []string
+	for u := range state.Feeds {
+		if !configured[u] {
+			removed = append(removed, u)
+			delete(state.Feeds, u)
+		}
+	}
+	sort.Strings(removed)
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	return removed, writeState(filename, state)
+}
+
+func writeState(filename string, state *State) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error encoding state: %w", err)
+	}
+
+	if err := writeFileAtomic(expandTilde(filename), data); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to filename and
+// renames it into place, so readers never see a partially written file.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// writeStatusFile records the time of the last poll and each feed's last
+// successful check as plain key=value lines, easy to inspect from a shell
+// healthcheck.
+func writeStatusFile(filename string, lastPoll time.Time, feeds []Feed) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "last_poll=%s\n", lastPoll.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "last_poll_unix=%d\n", lastPoll.Unix())
+	for _, feed := range feeds {
+		lastSuccess := "never"
+		if !feed.lastSuccess.IsZero() {
+			lastSuccess = feed.lastSuccess.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(&b, "feed=%s last_success=%s\n", feed.URL, lastSuccess)
+	}
+	for _, line := range sendFailures.lines() {
+		fmt.Fprintln(&b, line)
+	}
+
+	if err := writeFileAtomic(expandTilde(filename), []byte(b.String())); err != nil {
+		return fmt.Errorf("error writing status file: %w", err)
+	}
+	return nil
+}
+
+// newFeedBloomFilter returns an empty filter sized by the feed's
+// bloom_capacity and bloom_false_positive_rate.
+func newFeedBloomFilter(feed *Feed) *bloomFilter {
+	capacity := feed.BloomCapacity
+	if capacity <= 0 {
+		capacity = 10000
+	}
+	rate := feed.BloomFalsePositiveRate
+	if rate == 0 {
+		rate = 0.001
+	}
+	return newBloomFilter(capacity, rate)
+}
+
+// newBloomFilter sizes a filter for capacity items at the given false
+// positive rate.
+func newBloomFilter(capacity int, rate float64) *bloomFilter {
+	bits := math.Ceil(-float64(capacity) * math.Log(rate) / (math.Ln2 * math.Ln2))
+	hashes := int(math.Max(1, math.Round(bits/float64(capacity)*math.Ln2)))
+	return &bloomFilter{
+		Bits:   make([]byte, int(bits+7)/8),
+		Hashes: hashes,
+	}
+}
+
+// positions returns the bit positions for key using double hashing.
+func (b *bloomFilter) positions(key string) []uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31 | 1
+
+	m := uint64(len(b.Bits)) * 8
+	positions := make([]uint64, b.Hashes)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % m
+	}
+	return positions
+}
+
+func (b *bloomFilter) Add(key string) {
+	for _, p := range b.positions(key) {
+		b.Bits[p/8] |= 1 << (p % 8)
+	}
+}
+
+func (b *bloomFilter) Test(key string) bool {
+	for _, p := range b.positions(key) {
+		if b.Bits[p/8]&(1<<(p%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// newHashSet returns a hash set holding keys, oldest first.
+func newHashSet(keys []string) *hashSet {
+	h := &hashSet{index: map[string]bool{}}
+	for _, key := range keys {
+		h.Add(key)
+	}
+	return h
+}
+
+func (h *hashSet) Add(key string) {
+	if h.index[key] {
+		return
+	}
+	if len(h.keys) >= hashSetCapacity {
+		delete(h.index, h.keys[0])
+		h.keys = h.keys[1:]
+	}
+	h.keys = append(h.keys, key)
+	h.index[key] = true
+}
+
+func (h *hashSet) Remove(key string) {
+	if !h.index[key] {
+		return
+	}
+	delete(h.index, key)
+	for i, k := range h.keys {
+		if k == key {
+			h.keys = append(h.keys[:i], h.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+func (h *hashSet) Test(key string) bool {
+	return h.index[key]
+}
+
+// list returns the set's hashes for the state file, or nil for a nil set.
+func (h *hashSet) list() []string {
+	if h == nil {
+		return nil
+	}
+	return h.keys
+}
+
+// contentHash identifies an item by its title and link, for hash dedup mode,
+// or by its title and content for notify_on_content_change.
+func contentHash(title, link string) string {
+	h := fnv.New64a()
+	h.Write([]byte(strings.TrimSpace(title) + "\n" + strings.TrimSpace(link)))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// loadAuthFile reads a YAML mapping of ntfy topic or server URL to
+// credential, kept separate from the main config so it can hold secrets.
+func loadAuthFile(filename string) (map[string]string, error) {
+	data, err := os.ReadFile(expandTilde(filename))
+	if err != nil {
+		return nil, fmt.Errorf("error reading auth file: %w", err)
+	}
+
+	var tokens map[string]string
+	if err := yaml.UnmarshalStrict(data, &tokens); err != nil {
+		return nil, fmt.Errorf("error parsing auth file: %w", err)
+	}
+
+	normalized := make(map[string]string, len(tokens))
+	for key, token := range tokens {
+		if strings.TrimSpace(token) == "" {
+			return nil, fmt.Errorf("empty token for %s", key)
+		}
+		normalized[strings.TrimRight(key, "/")] = strings.TrimSpace(token)
+	}
+	return normalized, nil
+}
+
+// routeTopic returns the topic of the first route matching feed, or "".
+func routeTopic(routes []Route, feed *Feed) string {
+	for _, route := range routes {
+		if route.matches(feed) {
+			return route.NtfyTopic
+		}
+	}
+	return ""
+}
+
+// topicFor returns the topic feed's notifications are sent to: the first
+// matching route's topic, falling back to the feed's own ntfy_topic.
+func topicFor(feed *Feed) string {
+	return firstNonEmpty(routeTopic(routes, feed), feed.NtfyTopic)
+}
+
+// feedToken returns the feed's ntfy_token if topic is on the same server as
+// the feed's own ntfy_topic. A route may send the notification elsewhere, and
+// the feed's credential must not leak to that server.
+func feedToken(feed *Feed, topic string) string {
+	if feed.NtfyToken == "" || serverOf(topic) != serverOf(feed.NtfyTopic) {
+		return ""
+	}
+	return feed.NtfyToken
+}
+
+// serverOf returns the scheme and host of a topic URL.
+func serverOf(topic string) string {
+	if u, err := url.Parse(topic); err == nil && u.Host != "" {
+		return u.Scheme + "://" + u.Host
+	}
+	return topic
+}
+
+// tokenFor returns the credential for topic: the feed's own token if set,
+// otherwise the auth file entry for the topic, then for its server.
+func tokenFor(topic, feedToken string) string {
+	if feedToken != "" {
+		return feedToken
+	}
+	if token, ok := topicTokens[strings.TrimRight(topic, "/")]; ok {
+		return token
+	}
+	return topicTokens[serverOf(topic)]
+}
+
+// verifyTopics checks every topic the feeds notify, with the credential
+// each would be sent with, and writes one line per topic to w. It reports
+// whether all of them passed.
+func verifyTopics(w io.Writer, feeds []Feed, client *http.Client) bool {
+	type target struct{ topic, token string }
+	var targets []target
+	seen := map[target]bool{}
+	for i := range feeds {
+		topic := topicFor(&feeds[i])
+		t := target{topic, tokenFor(topic, feedToken(&feeds[i], topic))}
+		if !seen[t] {
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].topic < targets[j].topic })
+
+	ok := true
+	for _, t := range targets {
+		status, passed := checkTopic(client, t.topic, t.token)
+		if !passed {
+			ok = false
+		}
+		fmt.Fprintf(w, "%s: %s\n", redactURL(t.topic), status)
+	}
+	return ok
+}
+
+// checkTopic requests topic's /auth endpoint, which ntfy answers with 200
+// when the credential may read the topic, 401 when it isn't valid and 403
+// when it has no access, and describes the result.
+func checkTopic(client *http.Client, topic, token string) (string, bool) {
+	req, err := http.NewRequest("GET", strings.TrimRight(topic, "/")+"/auth", nil)
+	if err != nil {
+		return fmt.Sprintf("invalid topic: %v", err), false
+	}
+	if token != "" {
+		req.Header.Set("Authorization", authorizationHeader(token))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Sprintf("unreachable: %v", err), false
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK && token != "":
+		return "ok, token accepted", true
+	case resp.StatusCode == http.StatusOK:
+		return "ok", true
+	case resp.StatusCode == http.StatusUnauthorized && token != "":
+		return "token rejected (401)", false
+	case resp.StatusCode == http.StatusUnauthorized:
+		return "needs a token (401)", false
+	case resp.StatusCode == http.StatusForbidden && token != "":
+		// ntfy has no way to check write access without publishing.
+		return "token accepted, but not for reading the topic (403); check it may publish", true
+	case resp.StatusCode == http.StatusForbidden:
+		return "needs a token (403)", false
+	case resp.StatusCode == http.StatusNotFound:
+		return "reachable, but the server has no auth endpoint to check the token with (404)", true
+	}
+	return fmt.Sprintf("unexpected status %d", resp.StatusCode), false
+}
+
+// authorizationHeader formats an ntfy credential. Values already carrying an
+// auth scheme are used as is, "user:password" pairs are sent as basic auth,
+// and anything else, such as an ntfy access token ("tk_..."), as a bearer
+// token.
+func authorizationHeader(token string) string {
+	switch {
+	case strings.HasPrefix(token, "Bearer "), strings.HasPrefix(token, "Basic "):
+		return token
+	case strings.Contains(token, ":"):
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(token))
+	default:
+		return "Bearer " + token
+	}
+}
+
+// validateActions checks a feed's actions against ntfy's limits and parses
+// their templates.
+func validateActions(actions []Action) error {
+	if len(actions) > 3 {
+		return fmt.Errorf("at most 3 actions are allowed, got %d", len(actions))
+	}
+	for i, a := range actions {
+		switch a.Action {
+		case "view", "http", "broadcast":
+		default:
+			return fmt.Errorf("action %d: unknown action %q", i+1, a.Action)
+		}
+		if a.Label == "" {
+			return fmt.Errorf("action %d: label is required", i+1)
+		}
+		if a.Action == "http" && a.URL == "" {
+			return fmt.Errorf("action %d: url is required for http actions", i+1)
+		}
+		for _, text := range append([]string{a.URL, a.Body}, mapValues(a.Headers)...) {
+			if _, err := template.New("action").Funcs(templateFuncs).Parse(text); err != nil {
+				return fmt.Errorf("action %d: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// renderActions renders actions for an item as the JSON array accepted by
+// ntfy's X-Actions header. It returns "" when there are no actions.
+func renderActions(actions []Action, data templateData) (string, error) {
+	if len(actions) == 0 {
+		return "", nil
+	}
+
+	rendered := make([]Action, 0, len(actions))
+	for _, a := range actions {
+		var err error
+		if a.Action == "view" && a.URL == "" {
+			if data.Link == "" {
+				// Nothing to open for an item without a link.
+				continue
+			}
+			a.URL = data.Link
+		} else if a.URL, err = renderTemplate(a.URL, data); err != nil {
+			return "", err
+		}
+		if a.Body, err = renderTemplate(a.Body, data); err != nil {
+			return "", err
+		}
+		if len(a.Headers) > 0 {
+			headers := make(map[string]string, len(a.Headers))
+			for k, v := range a.Headers {
+				if headers[k], err = renderTemplate(v, data); err != nil {
+					return "", err
+				}
+			}
+			a.Headers = headers
+		}
+		rendered = append(rendered, a)
+	}
+	if len(rendered) == 0 {
+		return "", nil
+	}
+
+	out, err := json.Marshal(rendered)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// renderTemplate executes text as a template against data.
+func renderTemplate(text string, data templateData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New("").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// validateExec checks that an exec hook has a command whose templates parse.
+func validateExec(hook *ExecHook) error {
+	if hook == nil {
+		return nil
+	}
+	if len(hook.Command) == 0 {
+		return fmt.Errorf("exec: command is required")
+	}
+	if hook.Timeout < 0 {
+		return fmt.Errorf("exec: timeout must not be negative")
+	}
+	for _, arg := range hook.Command {
+		if _, err := template.New("exec").Funcs(templateFuncs).Parse(arg); err != nil {
+			return fmt.Errorf("exec: %w", err)
+		}
+	}
+	return nil
+}
+
+// runExec runs the feed's exec hook for an item, if it has one, and reports
+// whether the item's notification should still be sent.
+func runExec(hook *ExecHook, data templateData, logger *log.Entry) (bool, error) {
+	if hook == nil {
+		return true, nil
+	}
+	send := !hook.Instead
+
+	args := make([]string, len(hook.Command))
+	for i, arg := range hook.Command {
+		rendered, err := renderTemplate(arg, data)
+		if err != nil {
+			return send && !hook.Gate, fmt.Errorf("error rendering exec command: %w", err)
+		}
+		args[i] = rendered
+	}
+
+	timeout := hook.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "RSS_TITLE="+data.Title, "RSS_LINK="+data.Link, "RSS_FEED="+data.Feed)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return send && !hook.Gate, fmt.Errorf("exec hook timed out after %v", timeout)
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			logger.Infof("Exec hook exited with status %d: %s", exitErr.ExitCode(), strings.TrimSpace(string(output)))
+			return send && !hook.Gate, nil
+		}
+		return send && !hook.Gate, fmt.Errorf("error running exec hook: %w", err)
+	}
+	return send, nil
+}
+
+func mapValues(m map[string]string) []string {
+	values := make([]string, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// phoneNumberPattern matches E.164 phone numbers, as ntfy expects for X-Call.
+var phoneNumberPattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// callFor returns the X-Call value for an item with the given priority, or ""
+// when the feed doesn't call or the item isn't important enough.
+func callFor(feed *Feed, priority int) string {
+	if feed.Call == "" {
+		return ""
+	}
+	if priority == 0 {
+		priority = 3 // ntfy's default priority
+	}
+	minPriority := feed.CallMinPriority
+	if minPriority == 0 {
+		minPriority = 5
+	}
+	if priority < minPriority {
+		return ""
+	}
+	return feed.Call
+}
+
+// importancePriorities maps each importance to its ntfy priority.
+var importancePriorities = map[string]int{
+	"low":     2,
+	"default": 3,
+	"high":    4,
+	"urgent":  5,
+}
+
+// validatePriority checks that p is unset (0) or a valid ntfy priority.
+func validatePriority(p int) error {
+	if p < 0 || p > 5 {
+		return fmt.Errorf("priority %d must be between 1 and 5", p)
+	}
+	return nil
+}
+
+func expandTilde(path string) string {
+	if strings.HasPrefix(path, "~") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return path
+		}
+		return filepath.Join(home, path[1:])
+	}
+	return path
+}
+
+// processFeed checks feed once and sends notifications for its new items.
+func processFeed(feed *Feed, client *http.Client) FeedResult {
+	return processFeedContext(context.Background(), feed, client)
+}
+
+// processFeedContext is processFeed, giving up on the fetch and the sends
+// once ctx is done.
+func processFeedContext(ctx context.Context, feed *Feed, client *http.Client) FeedResult {
+	start := time.Now()
+	result := FeedResult{URL: feed.URL}
+	result.Err = checkFeed(ctx, feed, client, &result)
+	result.Duration = time.Since(start)
+	return result
+}
+
+func checkFeed(ctx context.Context, feed *Feed, client *http.Client, result *FeedResult) error {
+	logger := log.WithFields(log.Fields{"feed": feed.URL})
+	logger.Infof("Checking feed")
+
+	if err := sendDigest(ctx, feed, result, logger); err != nil {
+		logger.Errorf("Error sending throttle digest: %v", err)
+	}
+
+	format, rss, atom, err := fetchFeed(ctx, feed, withTimeout(clientFor(feed, client), feed.FetchTimeout), logger)
+	if err != nil {
+		return err
+	}
+
+	resolveFeedLinks(feed.URL, rss, atom)
+	checkEmpty(feed, rss, atom, logger)
+	if recovering(feed) {
+		logger.Info("Feed recovered after failing for longer than its interval, not notifying the items it missed")
+		catchUp(feed)
+	}
+
+	if atom != nil {
+		logger.Info("Processing as Atom feed")
+		err = processAtomFeed(ctx, feed, *atom, result, logger)
+		result.Next = atom.nextPage(feed.URL)
+	} else {
+		logger.Infof("Processing as %s feed", strings.ToUpper(format))
+		err = processRSSFeed(ctx, feed, *rss, result, logger)
+	}
+	feed.primed = true
+
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNotify, err)
+	}
+	return nil
+}
+
+// checkEmpty records how many items the parsed feed has and, for a feed with
+// AlertOnEmpty, reports to the error topic when it had items at the last
+// check and has none now. A feed that has always been empty isn't reported.
+func checkEmpty(feed *Feed, rss *Rss, atom *Atom, logger *log.Entry) {
+	count := 0
+	if atom != nil {
+		count = len(atom.Entries)
+	} else if rss != nil {
+		count = len(rss.Channel.Item)
+	}
+	if feed.AlertOnEmpty && count == 0 && feed.itemCount > 0 {
+		logger.Warnf("Feed is empty, it had %d items at the last check", feed.itemCount)
+		reportError("feed is empty", fmt.Sprintf("%s has no items, it had %d at the last check.", feed.URL, feed.itemCount))
+	}
+	feed.itemCount = count
+}
+
+// fetchFeed fetches and parses the feed, returning ErrFetch or ErrParse
+// wrapped errors. Feeds whose format is rss or atom are decoded as the
+// response streams in, unless their body is needed whole for a splitter or
+// -dump-parse-errors. Other feeds are read into memory first so their
+// format can be detected.
+func fetchFeed(ctx context.Context, feed *Feed, client *http.Client, logger *log.Entry) (string, *Rss, *Atom, error) {
+	if (feed.Format == "rss" || feed.Format == "atom") && feed.Splitter == "" && parseDumpDir == "" {
+		rss, atom, err := decodeFeedStream(ctx, feed, client, logger)
+		return feed.Format, rss, atom, err
+	}
+
+	body, err := fetchFeedBody(ctx, feed, client, logger)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	var format string
+	var rss *Rss
+	var atom *Atom
+	if feed.Splitter != "" {
+		format, rss, atom, err = parseSplitFeed(feed, body)
+	} else {
+		format, rss, atom, err = parseFeedFor(feed, body)
+	}
+	if err != nil {
+		if parseDumpDir != "" {
+			dumpParseFailure(feed, body, err, logger)
+		}
+		return "", nil, nil, fmt.Errorf("%w: %w", ErrParse, err)
+	}
+	return format, rss, atom, nil
+}
+
+// decodeFeedStream decodes an RSS or Atom feed, as given by its format,
+// straight from the response without buffering the document. A response
+// that isn't such a feed fails at its root element, so maxFeedSize isn't
+// needed to stop reading it.
+func decodeFeedStream(ctx context.Context, feed *Feed, client *http.Client, logger *log.Entry) (*Rss, *Atom, error) {
+	r, err := openFeed(ctx, feed, client, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	decoder := xml.NewDecoder(r)
+	var rss *Rss
+	var atom *Atom
+	if feed.Format == "atom" {
+		atom = &Atom{}
+		err = decoder.Decode(atom)
+	} else {
+		rss = &Rss{}
+		err = decoder.Decode(rss)
+	}
+	var syntaxErr *xml.SyntaxError
+	var unmarshalErr xml.UnmarshalError
+	switch {
+	case errors.As(err, &syntaxErr) || errors.As(err, &unmarshalErr):
+		return nil, nil, fmt.Errorf("%w: %w", ErrParse, err)
+	case err != nil:
+		return nil, nil, fmt.Errorf("%w: error reading feed: %w", ErrFetch, err)
+	}
+	return rss, atom, nil
+}
+
+// parseDumpDir is the -dump-parse-errors directory, and parseDumpSize the
+// most body bytes written to each dump.
+var (
+	parseDumpDir  string
+	parseDumpSize = 64 << 10
+)
+
+// dumpParseFailure writes the body of a feed that failed to parse to a new
+// file in parseDumpDir, truncated to parseDumpSize bytes. Credentials in the
+// feed URL are redacted; the request body is left out as it may hold some.
+func dumpParseFailure(feed *Feed, body []byte, parseErr error, logger *log.Entry) {
+	shown := body
+	if len(shown) > parseDumpSize {
+		shown = shown[:parseDumpSize]
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "URL: %s\n", redactURL(feed.URL))
+	fmt.Fprintf(&b, "Error: %v\n", parseErr)
+	fmt.Fprintf(&b, "Size: %d bytes, %d shown\n\n", len(body), len(shown))
+	b.Write(shown)
+
+	name := "feed"
+	if u, err := url.Parse(feed.URL); err == nil && u.Hostname() != "" {
+		name = u.Hostname()
+	}
+	filename := filepath.Join(expandTilde(parseDumpDir), fmt.Sprintf("%s-%s.txt", name, clock.Now().UTC().Format("20060102T150405.000000000Z")))
+	if err := writeFileAtomic(filename, b.Bytes()); err != nil {
+		logger.Errorf("Error writing parse failure dump: %v", err)
+		return
+	}
+	logger.Infof("Wrote response body that failed to parse to %s", filename)
+}
+
+// sensitiveQueryParams are query parameter names whose values redactURL
+// hides.
+var sensitiveQueryParams = []string{"token", "key", "apikey", "api_key", "password", "secret", "auth", "access_token"}
+
+// redactURL hides the password and any credential-like query parameters of
+// a URL.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	query := u.Query()
+	for name := range query {
+		for _, sensitive := range sensitiveQueryParams {
+			if strings.EqualFold(name, sensitive) {
+				query.Set(name, "REDACTED")
+			}
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.Redacted()
+}
+
+// requestURL returns the URL the feed is requested from: its url with the
+// api_key query parameter added, if it has one.
+func requestURL(feed *Feed) string {
+	if feed.APIKeyParam == "" {
+		return feed.URL
+	}
+	u, err := url.Parse(feed.URL)
+	if err != nil {
+		return feed.URL
+	}
+	query := u.Query()
+	query.Set(feed.APIKeyParam, feed.APIKey)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// redactRequestError replaces the request URL in err, which includes the
+// feed's API key, with the feed's configured url.
+func redactRequestError(feed *Feed, err error) error {
+	var urlErr *url.Error
+	if feed.APIKeyParam != "" && errors.As(err, &urlErr) {
+		urlErr.URL = feed.URL
+	}
+	return err
+}
+
+// openFeed requests the feed, or opens a file:// feed, returning its body
+// once the response has passed the checks made before reading it. Errors
+// are ErrFetch or ErrParse wrapped.
+func openFeed(ctx context.Context, feed *Feed, client *http.Client, logger *log.Entry) (io.ReadCloser, error) {
+	if path, ok := feedFilePath(feed.URL); ok {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrFetch, err)
+		}
+		return f, nil
+	}
+
+	resp, err := requestFeed(ctx, feed, client)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFetch, err)
+	}
+
+	logger.Infof("Response status code: %d", resp.StatusCode)
+
+	if cloudflareChallenge(resp) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %w", ErrFetch, errCloudflareChallenge)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); !feed.IgnoreContentType && autoFormat(feed) && !feedContentType(contentType) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: content type %q is not a feed type (set ignore_content_type if the server mislabels the feed)", ErrParse, contentType)
+	}
+	return resp.Body, nil
+}
+
+// requestFeed sends the request for feed. A feed with a login is fetched
+// with the session cookies of its login, logging in first if it hasn't yet
+// and again, once, if the session has expired.
+func requestFeed(ctx context.Context, feed *Feed, client *http.Client) (*http.Response, error) {
+	if feed.Login == nil {
+		return sendFeedRequest(ctx, feed, client)
+	}
+	if feed.jar == nil {
+		if err := login(ctx, feed, client); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := sendFeedRequest(ctx, feed, withJar(client, feed.jar))
+	if err != nil || !sessionExpired(feed.Login, resp) {
+		return resp, err
+	}
+	resp.Body.Close()
+	log.WithField("feed", feed.URL).Info("Login session expired, logging in again")
+	if err := login(ctx, feed, client); err != nil {
+		return nil, err
+	}
+	return sendFeedRequest(ctx, feed, withJar(client, feed.jar))
+}
+
+func sendFeedRequest(ctx context.Context, feed *Feed, client *http.Client) (*http.Response, error) {
+	var reqBody io.Reader
+	if feed.Body != "" {
+		reqBody = strings.NewReader(feed.Body)
+	}
+	method := strings.ToUpper(firstNonEmpty(feed.Method, "GET"))
+	req, err := http.NewRequestWithContext(ctx, method, requestURL(feed), reqBody)
+	if err != nil {
+		return nil, redactRequestError(feed, err)
+	}
+
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, redactRequestError(feed, err)
+	}
+	return resp, nil
+}
+
+const userAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36"
+
+// login posts the login form of feed and keeps the cookies it sets as the
+// feed's session.
+func login(ctx context.Context, feed *Feed, client *http.Client) error {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	form := url.Values{}
+	for name, value := range feed.Login.Fields {
+		form.Set(name, value)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", feed.Login.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("logging in: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := withJar(client, jar).Do(req)
+	if err != nil {
+		return fmt.Errorf("logging in: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("logging in: status code %d", resp.StatusCode)
+	}
+	feed.jar = jar
+	return nil
+}
+
+// sessionExpired reports whether resp, the response to a feed request,
+// shows that the login session is no longer valid: the server answered 401
+// or redirected to the login page.
+func sessionExpired(login *Login, resp *http.Response) bool {
+	if resp.StatusCode == http.StatusUnauthorized {
+		return true
+	}
+	loginURL, err := url.Parse(login.URL)
+	if err != nil {
+		return false
+	}
+	u := resp.Request.URL
+	return u.Host == loginURL.Host && u.Path == loginURL.Path
+}
+
+// withJar returns a copy of client that keeps cookies in jar.
+func withJar(client *http.Client, jar http.CookieJar) *http.Client {
+	c := *client
+	c.Jar = jar
+	return &c
+}
+
+// fetchFeedBody requests the feed and reads its body, returning ErrFetch or
+// ErrParse wrapped errors.
+func fetchFeedBody(ctx context.Context, feed *Feed, client *http.Client, logger *log.Entry) ([]byte, error) {
+	r, err := openFeed(ctx, feed, client, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	body, err := readFeedBody(r, maxFeedSize)
+	if errors.Is(err, errNotAFeed) {
+		return nil, fmt.Errorf("%w: %w", ErrParse, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: error reading feed: %w", ErrFetch, err)
+	}
+	return body, nil
+}
+
+// exampleConfig is the config written by -init. Its uncommented settings
+// load as is, so it can be tried out right after changing the topics.
+const exampleConfig = `# rss-to-ntfy config. Durations are Go durations such as 30s, 10m or 2h.
+
+# How often feeds are checked, unless -interval is given.
+interval: 10m
+
+# Settings applied to every feed that doesn't set them itself.
+defaults:
+  ntfy_topic: https://ntfy.sh/replace-with-your-topic
+  # ntfy_token: tk_...            # or keep tokens in a separate -auth-file
+  # priority: 3                   # 1 (min) to 5 (max)
+  # fetch_timeout: 30s
+  # notify_timeout: 30s
+  # max_item_age: 168h            # don't notify items older than a week
+
+feeds:
+  # The simplest feed uses the defaults above.
+  - url: https://blog.golang.org/feed.atom
+
+  # A feed with its own topic and a few common options.
+  - url: https://github.com/golang/go/releases.atom
+    ntfy_topic: https://ntfy.sh/replace-with-another-topic
+    importance: high            # low, default, high or urgent
+    # icon: https://go.dev/favicon.ico
+    # newest_only: true           # only notify the newest new item of each check
+    # single_line: true           # "Title — link" instead of separate lines
+    # max_body: 160               # truncate messages, e.g. for SMS
+    # min_interval: 1h            # never check more often than this
+    # dedup_mode: bloom           # timestamp (default), bloom or hash
+    # match: "category = 'Security'"
+    # priority_keywords:
+    #   security: 5
+    # rules:
+    #   - keywords: [cve]
+    #     message_template: "Security: {{ .Title }} {{ .Link }}"
+    #     priority: 5
+    #     tags: warning
+
+# Check some feeds at their own interval with "group: news" on the feed.
+# groups:
+#   news: 5m
+
+# Send notifications of matching feeds to another topic.
+# routes:
+#   - url: "https://github.com/*"
+#     ntfy_topic: https://ntfy.sh/releases
+
+# Retry failed notifications, and redeliver them from -dead-letter files.
+# notify_retry:
+#   attempts: 3
+#   backoff: 1s
+#   redeliveries: 10
+
+# Stop notifying a server for a while after repeated failures.
+# circuit_breaker:
+#   failures: 5
+#   cooldown: 5m
+
+# Send at most this many notifications per period.
+# rate_limit:
+#   notifications: 30
+#   period: 1m
+
+# Spread the first checks over the interval instead of checking every feed
+# at startup, and don't notify anything in the first few minutes.
+# stagger_start: true
+# startup_grace: 5m
+
+# Time zone for dates in templates, e.g. Europe/Berlin.
+# display_timezone: UTC
+`
+
+// writeExampleConfig writes exampleConfig to path, or to stdout if path is
+// "". An existing file is never overwritten.
+func writeExampleConfig(path string) error {
+	if path == "" {
+		_, err := io.WriteString(os.Stdout, exampleConfig)
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, exampleConfig); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Infof("Wrote example config to %s", path)
+	return nil
+}
+
+// diffConfigFiles loads two config files, with defaults applied, and writes
+// the settings and feeds that differ between them to w.
+func diffConfigFiles(w io.Writer, oldFile, newFile string) error {
+	oldConfig, err := loadConfig(oldFile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", oldFile, err)
+	}
+	newConfig, err := loadConfig(newFile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", newFile, err)
+	}
+
+	// Defaults are already merged into the feeds, so only the remaining
+	// top-level settings are compared as settings.
+	settings := func(c *Config) Config {
+		c2 := *c
+		c2.Defaults = nil
+		c2.Feeds = nil
+		return c2
+	}
+	settingChanges, err := diffFields(settings(oldConfig), settings(newConfig))
+	if err != nil {
+		return err
+	}
+	if len(settingChanges) > 0 {
+		fmt.Fprintln(w, "Settings:")
+		for _, change := range settingChanges {
+			fmt.Fprintf(w, "  ~ %s\n", change)
+		}
+	}
+
+	oldFeeds := map[string]Feed{}
+	for _, feed := range oldConfig.Feeds {
+		oldFeeds[feed.URL] = feed
+	}
+	newFeeds := map[string]bool{}
+
+	var feedLines []string
+	for _, feed := range newConfig.Feeds {
+		newFeeds[feed.URL] = true
+		old, ok := oldFeeds[feed.URL]
+		if !ok {
+			feedLines = append(feedLines, "  + "+feed.URL)
+			continue
+		}
+		changes, err := diffFields(old, feed)
+		if err != nil {
+			return err
+		}
+		if len(changes) > 0 {
+			feedLines = append(feedLines, "  ~ "+feed.URL)
+			for _, change := range changes {
+				feedLines = append(feedLines, "      "+change)
+			}
+		}
+	}
+	for _, feed := range oldConfig.Feeds {
+		if !newFeeds[feed.URL] {
+			feedLines = append(feedLines, "  - "+feed.URL)
+		}
+	}
+	if len(feedLines) > 0 {
+		fmt.Fprintln(w, "Feeds:")
+		for _, line := range feedLines {
+			fmt.Fprintln(w, line)
+		}
+	}
+
+	if len(settingChanges) == 0 && len(feedLines) == 0 {
+		fmt.Fprintln(w, "No differences")
+	}
+	return nil
+}
+
+// diffFields compares the YAML encodings of two values key by key and
+// describes each key whose value differs, in key order.
+func diffFields(oldValue, newValue interface{}) ([]string, error) {
+	decode := func(v interface{}) (map[string]interface{}, error) {
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]interface{}
+		return m, yaml.Unmarshal(data, &m)
+	}
+	oldMap, err := decode(oldValue)
+	if err != nil {
+		return nil, err
+	}
+	newMap, err := decode(newValue)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	for key := range oldMap {
+		keys[key] = true
+	}
+	for key := range newMap {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var changes []string
+	for _, key := range sorted {
+		if !reflect.DeepEqual(oldMap[key], newMap[key]) {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", key, oldMap[key], newMap[key]))
+		}
+	}
+	return changes, nil
+}
+
+// feedFilePath returns the path of a file:// feed URL, and false for any other
+// URL.
+func feedFilePath(feedURL string) (string, bool) {
+	u, err := url.Parse(feedURL)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return firstNonEmpty(u.Path, u.Opaque), true
+}
+
+// listFormats fetches a feed and prints each item's raw date string along
+// with the parseDate layout it matched, to help diagnose unparseable dates.
+func listFormats(feedURL string, client *http.Client) error {
+	feed := &Feed{URL: feedURL}
+	body, err := fetchFeedBody(context.Background(), feed, client, log.WithField("feed", feedURL))
+	if err != nil {
+		return err
+	}
+
+	format, rss, atom, err := parseFeedBody(body)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrParse, err)
+	}
+
+	var dates []string
+	if atom != nil {
+		format = "atom"
+		for _, entry := range atom.Entries {
+			dates = append(dates, entry.Published)
+		}
+	} else {
+		for _, item := range rss.Channel.Item {
+			dates = append(dates, item.Published)
+		}
+	}
+
+	fmt.Printf("Feed format: %s, %d items\n\n", format, len(dates))
+	for _, date := range dates {
+		if _, layout, err := matchDateFormat(date); err == nil {
+			fmt.Printf("%q\tmatched %q\n", date, layout)
+		} else {
+			fmt.Printf("%q\tNO MATCH\n", date)
+		}
+	}
+	return nil
+}
+
+var errNotAFeed = errors.New("not a feed or too large")
+
+var errCloudflareChallenge = errors.New("feed is behind a Cloudflare challenge, which only a browser can pass; ask the site to exempt the feed or find a mirror")
+
+// cloudflareChallenge reports whether resp is a Cloudflare "Just a moment"
+// interstitial instead of the feed. Cloudflare marks those with a
+// cf-mitigated header; older challenges are recognized by their page. The
+// body is only read for Cloudflare's 403 and 503 responses, and not put back.
+func cloudflareChallenge(resp *http.Response) bool {
+	if resp.Header.Get("Cf-Mitigated") == "challenge" {
+		return true
+	}
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusServiceUnavailable {
+		return false
+	}
+	if !strings.EqualFold(resp.Header.Get("Server"), "cloudflare") {
+		return false
+	}
+	page, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return bytes.Contains(page, []byte("Just a moment...")) || bytes.Contains(page, []byte("/cdn-cgi/challenge-platform/"))
+}
+
+// feedContentType reports whether a response Content-Type may hold a feed:
+// any XML or JSON type, or one of the generic types servers often use for
+// feeds. A missing Content-Type is accepted too.
+func feedContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "text/xml", "application/xml", "application/json", "text/json", "text/plain", "application/octet-stream":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+xml") || strings.HasSuffix(mediaType, "+json")
+}
+
+// readFeedBody reads a response body, scanning it as XML while it streams in.
+// If limit bytes are read without reaching the first item or entry, reading
+// stops and errNotAFeed is returned, so a large HTML page or other non-feed
+// response is never buffered whole. Once an item has been seen the rest of
+// the body is read in full.
+func readFeedBody(r io.Reader, limit int64) ([]byte, error) {
+	var buf bytes.Buffer
+	limited := &io.LimitedReader{R: r, N: limit + 1}
+	decoder := xml.NewDecoder(io.TeeReader(limited, &buf))
+
+	for {
+		tok, err := decoder.RawToken()
+		if err != nil {
+			// End of input, the limit, or a document that isn't XML
+			// (such as a JSON feed): fall back to the plain limit.
+			break
+		}
+		if start, ok := tok.(xml.StartElement); ok && (start.Name.Local == "item" || start.Name.Local == "entry") {
+			_, err := io.Copy(&buf, r)
+			return buf.Bytes(), err
+		}
+	}
+
+	if _, err := io.Copy(&buf, limited); err != nil {
+		return nil, err
+	}
+	if limited.N == 0 {
+		return nil, fmt.Errorf("%w: no items in the first %d bytes", errNotAFeed, limit)
+	}
+	return buf.Bytes(), nil
+}
+
+// parseFeedFor decodes body as the feed's format, or whatever
+// parseFeedBody detects when it has none.
+func parseFeedFor(feed *Feed, body []byte) (string, *Rss, *Atom, error) {
+	switch feed.Format {
+	case "hfeed":
+		rss, err := parseHFeed(body, feed.URL)
+		return "hfeed", rss, nil, err
+	case "rss", "atom", "json":
+		rss, atom, _, err := parseFeedAs(feed.Format, body)
+		return feed.Format, rss, atom, err
+	}
+	return parseFeedBody(body)
+}
+
+// splitters divide a response holding several feed documents into the
+// documents, for feeds with a splitter. Further splitters are added here.
+var splitters = map[string]func(body []byte) ([][]byte, error){
+	"xml":  splitXMLDocuments,
+	"json": splitJSONDocuments,
+}
+
+// parseSplitFeed splits body with the feed's splitter and parses each
+// document, merging their items into one feed. The documents must all be
+// Atom, or all RSS or JSON feeds.
+func parseSplitFeed(feed *Feed, body []byte) (string, *Rss, *Atom, error) {
+	docs, err := splitters[feed.Splitter](body)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("error splitting response with the %s splitter: %w", feed.Splitter, err)
+	}
+	if len(docs) == 0 {
+		return "", nil, nil, fmt.Errorf("the %s splitter found no documents", feed.Splitter)
+	}
+
+	var format string
+	var merged *Rss
+	var mergedAtom *Atom
+	for i, doc := range docs {
+		docFormat, rss, atom, err := parseFeedFor(feed, doc)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("document %d: %w", i+1, err)
+		}
+		if i > 0 && (atom != nil) != (mergedAtom != nil) {
+			return "", nil, nil, fmt.Errorf("document %d: can't mix Atom with other feed formats", i+1)
+		}
+		switch {
+		case i == 0:
+			format, merged, mergedAtom = docFormat, rss, atom
+		case atom != nil:
+			mergedAtom.Entries = append(mergedAtom.Entries, atom.Entries...)
+		default:
+			merged.Channel.Item = append(merged.Channel.Item, rss.Channel.Item...)
+		}
+	}
+	return format, merged, mergedAtom, nil
+}
+
+// splitXMLDocuments splits XML documents written one after another, each
+// ending with its root element.
+func splitXMLDocuments(body []byte) ([][]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	var docs [][]byte
+	start, depth := int64(0), 0
+	for {
+		tok, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				end := decoder.InputOffset()
+				docs = append(docs, body[start:end])
+				start = end
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("the last document is incomplete")
+	}
+	return docs, nil
+}
+
+// splitJSONDocuments splits JSON values written one after another, such as
+// JSON Lines, or the elements of a JSON array.
+func splitJSONDocuments(body []byte) ([][]byte, error) {
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var values []json.RawMessage
+		if err := json.Unmarshal(trimmed, &values); err != nil {
+			return nil, err
+		}
+		docs := make([][]byte, len(values))
+		for i, v := range values {
+			docs[i] = v
+		}
+		return docs, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	var docs [][]byte
+	for {
+		var v json.RawMessage
+		err := decoder.Decode(&v)
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, v)
+	}
+}
+
+// autoFormat reports whether the feed's format is detected from the
+// response. A feed whose format is set is parsed as that whatever its
+// Content-Type.
+func autoFormat(feed *Feed) bool {
+	return feed.Format == "" || feed.Format == "auto"
+}
+
+// parseHFeed extracts the h-entry items of a microformats2 h-feed from an
+// HTML page, converting them to RSS items. An entry's title is its p-name,
+// its link the u-url and its date the dt-published, preferring the href and
+// datetime attributes over text. Relative links are resolved against
+// pageURL, and entries nested inside another entry are ignored.
+func parseHFeed(body []byte, pageURL string) (*Rss, error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Scripts and styles may contain "<", which even the non-strict XML
+	// decoder can't handle, and never hold microformats.
+	body = htmlScriptPattern.ReplaceAll(body, nil)
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	// property collects the text of an element holding entry properties
+	// that have no attribute value.
+	type property struct {
+		names []string
+		depth int
+		text  strings.Builder
+	}
+
+	var rss Rss
+	var entry *Item
+	var entryDepth int
+	var prop *property
+	var nestedDepth int
+	depth := 0
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing HTML: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			classes := strings.Fields(htmlAttr(t, "class"))
+			if entry == nil {
+				if hasClass(classes, "h-entry") {
+					entry = &Item{}
+					entryDepth = depth
+				}
+				continue
+			}
+			if prop != nil || nestedDepth > 0 {
+				continue
+			}
+			if hasClass(classes, "h-entry") {
+				nestedDepth = depth
+				continue
+			}
+			var names []string
+			if hasClass(classes, "p-name") && entry.Title == "" {
+				names = append(names, "name")
+			}
+			if hasClass(classes, "u-url") && entry.Link == "" {
+				if href := htmlAttr(t, "href"); href != "" {
+					entry.Link = resolveLink(base, href)
+				} else {
+					names = append(names, "url")
+				}
+			}
+			if hasClass(classes, "dt-published") && entry.Published == "" {
+				if datetime := htmlAttr(t, "datetime"); datetime != "" {
+					entry.Published = datetime
+				} else {
+					names = append(names, "published")
+				}
+			}
+			if len(names) > 0 {
+				prop = &property{names: names, depth: depth}
+			}
+		case xml.CharData:
+			if prop != nil {
+				prop.text.Write(t)
+			}
+		case xml.EndElement:
+			if depth == nestedDepth {
+				nestedDepth = 0
+			}
+			if prop != nil && depth == prop.depth {
+				text := strings.Join(strings.Fields(prop.text.String()), " ")
+				for _, name := range prop.names {
+					switch name {
+					case "name":
+						entry.Title = text
+					case "url":
+						entry.Link = resolveLink(base, text)
+					case "published":
+						entry.Published = text
+					}
+				}
+				prop = nil
+			}
+			if entry != nil && depth == entryDepth {
+				rss.Channel.Item = append(rss.Channel.Item, *entry)
+				entry = nil
+			}
+			depth--
+		}
+	}
+
+	rss.Channel.Links = []string{pageURL}
+	if len(rss.Channel.Item) == 0 {
+		return nil, fmt.Errorf("no h-entry items found")
+	}
+	return &rss, nil
+}
+
+var htmlScriptPattern = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)\s*>`)
+
+// feedContent returns the notification body for an item's HTML content, or
+// "" unless the feed has html_content set.
+func feedContent(feed *Feed, content string) string {
+	if !feed.HTMLContent {
+		return ""
+	}
+	return htmlToMarkdown(content)
+}
+
+// htmlToMarkdown converts HTML to the Markdown ntfy renders. Only paragraphs,
+// headings, line breaks, emphasis, http(s) links, lists, code and quotes are
+// kept; other elements are dropped along with their markup but not their
+// text, and text is escaped so it can't add formatting of its own.
+func htmlToMarkdown(content string) string {
+	content = htmlScriptPattern.ReplaceAllString(content, "")
+	decoder := xml.NewDecoder(strings.NewReader(content))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var b strings.Builder
+	block := func() {
+		if b.Len() > 0 {
+			b.WriteString("\n\n")
+		}
+	}
+	var links []string // href of each open <a>, "" if it isn't kept
+	var lists []int    // items so far in each open list, -1 for <ul>
+	pre, code := 0, 0
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			// Keep what was converted before malformed markup.
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch name := strings.ToLower(t.Name.Local); name {
+			case "p", "div", "table":
+				block()
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				block()
+				b.WriteString("**")
+			case "blockquote":
+				block()
+				b.WriteString("> ")
+			case "pre":
+				block()
+				b.WriteString("```\n")
+				pre++
+			case "br":
+				b.WriteString("\n")
+			case "b", "strong":
+				b.WriteString("**")
+			case "i", "em":
+				b.WriteString("_")
+			case "code":
+				if pre == 0 {
+					b.WriteString("`")
+					code++
+				}
+			case "a":
+				href := htmlAttr(t, "href")
+				if u, err := url.Parse(href); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+					href = ""
+				}
+				if href != "" {
+					b.WriteString("[")
+				}
+				links = append(links, href)
+			case "ul", "ol":
+				if len(lists) == 0 {
+					block()
+				}
+				if name == "ul" {
+					lists = append(lists, -1)
+				} else {
+					lists = append(lists, 0)
+				}
+			case "li":
+				b.WriteString("\n" + strings.Repeat("  ", max(len(lists)-1, 0)))
+				if n := len(lists); n > 0 && lists[n-1] >= 0 {
+					lists[n-1]++
+					fmt.Fprintf(&b, "%d. ", lists[n-1])
+				} else {
+					b.WriteString("- ")
+				}
+			}
+		case xml.EndElement:
+			switch strings.ToLower(t.Name.Local) {
+			case "p", "div", "table", "blockquote":
+				block()
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				b.WriteString("**")
+				block()
+			case "pre":
+				b.WriteString("\n```")
+				block()
+				pre = max(pre-1, 0)
+			case "b", "strong":
+				b.WriteString("**")
+			case "i", "em":
+				b.WriteString("_")
+			case "code":
+				if pre == 0 && code > 0 {
+					b.WriteString("`")
+					code--
+				}
+			case "a":
+				if n := len(links); n > 0 {
+					if links[n-1] != "" {
+						fmt.Fprintf(&b, "](%s)", links[n-1])
+					}
+					links = links[:n-1]
+				}
+			case "ul", "ol":
+				if n := len(lists); n > 0 {
+					lists = lists[:n-1]
+				}
+				if len(lists) == 0 {
+					block()
+				}
+			}
+		case xml.CharData:
+			if pre > 0 {
+				b.Write(t)
+				continue
+			}
+			if code > 0 {
+				// Code spans show backslashes literally, and only a
+				// backtick could end one early.
+				b.WriteString(strings.ReplaceAll(string(t), "`", "'"))
+				continue
+			}
+			text := htmlSpacePattern.ReplaceAllString(string(t), " ")
+			if out := b.String(); out == "" || strings.HasSuffix(out, "\n") || strings.HasSuffix(out, " ") {
+				text = strings.TrimLeft(text, " ")
+			}
+			b.WriteString(markdownEscape(text))
+		}
+	}
+
+	out := strings.TrimSpace(b.String())
+	return markdownBlankLines.ReplaceAllString(out, "\n\n")
+}
+
+var (
+	htmlSpacePattern   = regexp.MustCompile(`\s+`)
+	markdownBlankLines = regexp.MustCompile(`\n[ \n]*\n`)
+	markdownEscaper    = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "#", `\#`, ">", `\>`)
+)
+
+// markdownEscape escapes the characters in text that Markdown would treat as
+// formatting.
+func markdownEscape(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+// htmlAttr returns the value of an element's attribute, or "".
+func htmlAttr(el xml.StartElement, name string) string {
+	for _, attr := range el.Attr {
+		if strings.EqualFold(attr.Name.Local, name) {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+func hasClass(classes []string, class string) bool {
+	for _, c := range classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveFeedLinks resolves relative item and entry links against the feed
+// URL and any xml:base attributes of the elements containing them.
+func resolveFeedLinks(feedURL string, rss *Rss, atom *Atom) {
+	base, err := url.Parse(feedURL)
+	if err != nil {
+		return
+	}
+	if rss != nil {
+		channelBase := withXMLBase(withXMLBase(base, rss.Base), rss.Channel.Base)
+		for i := range rss.Channel.Item {
+			item := &rss.Channel.Item[i]
+			if item.Link != "" {
+				item.Link = resolveLink(withXMLBase(channelBase, item.Base), item.Link)
+			}
+		}
+	}
+	if atom != nil {
+		feedBase := withXMLBase(base, atom.Base)
+		for i := range atom.Entries {
+			entry := &atom.Entries[i]
+			if entry.Link.Href != "" {
+				entry.Link.Href = resolveLink(withXMLBase(withXMLBase(feedBase, entry.Base), entry.Link.Base), entry.Link.Href)
+			}
+		}
+	}
+}
+
+// withXMLBase returns the base URL inside an element with the xml:base
+// attribute xmlBase, which may itself be relative to base.
+func withXMLBase(base *url.URL, xmlBase string) *url.URL {
+	if xmlBase == "" {
+		return base
+	}
+	u, err := base.Parse(strings.TrimSpace(xmlBase))
+	if err != nil {
+		return base
+	}
+	return u
+}
+
+// resolveLink resolves a possibly relative link against base.
+func resolveLink(base *url.URL, link string) string {
+	u, err := base.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return link
+	}
+	return u.String()
+}
+
+// parseFeedBody decodes body as RSS, Atom or JSON Feed, trying the format
+// detected from the document first. A parse that succeeds but yields no items
+// is not trusted on its own: the remaining formats are tried, and the empty
+// result is only used if none of them finds any items. JSON feeds are
+// converted to RSS so they share its processing path.
+func parseFeedBody(body []byte) (string, *Rss, *Atom, error) {
+	formats := []string{"rss", "atom", "json"}
+	if detected := detectFormat(body); detected != "" {
+		ordered := []string{detected}
+		for _, f := range formats {
+			if f != detected {
+				ordered = append(ordered, f)
+			}
+		}
+		formats = ordered
+	}
+
+	var firstErr error
+	var emptyFormat string
+	var emptyRSS *Rss
+	var emptyAtom *Atom
+	for _, format := range formats {
+		rss, atom, count, err := parseFeedAs(format, body)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if count > 0 {
+			return format, rss, atom, nil
+		}
+		if emptyFormat == "" {
+			emptyFormat, emptyRSS, emptyAtom = format, rss, atom
+		}
+	}
+
+	if emptyFormat != "" {
+		return emptyFormat, emptyRSS, emptyAtom, nil
+	}
+	return "", nil, nil, firstErr
+}
+
+// parseFeedAs decodes body as a single format, returning the number of
+// items found.
+func parseFeedAs(format string, body []byte) (*Rss, *Atom, int, error) {
+	switch format {
+	case "rss":
+		var rss Rss
+		if err := xml.Unmarshal(body, &rss); err != nil {
+			return nil, nil, 0, err
+		}
+		return &rss, nil, len(rss.Channel.Item), nil
+	case "atom":
+		var atom Atom
+		if err := xml.Unmarshal(body, &atom); err != nil {
+			return nil, nil, 0, err
+		}
+		return nil, &atom, len(atom.Entries), nil
+	case "json":
+		var jf JSONFeed
+		if err := json.Unmarshal(body, &jf); err != nil {
+			return nil, nil, 0, err
+		}
+		if !strings.HasPrefix(jf.Version, "https://jsonfeed.org/version/") {
+			return nil, nil, 0, fmt.Errorf("not a JSON feed: missing version")
+		}
+		rss := jf.toRSS()
+		return &rss, nil, len(rss.Channel.Item), nil
+	}
+	return nil, nil, 0, fmt.Errorf("unknown feed format %q", format)
+}
+
+// detectFormat guesses the feed format from the document's root element, or
+// returns "json" for documents that look like JSON. It returns "" when the
+// format can't be determined.
+func detectFormat(body []byte) string {
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		return "json"
+	}
+	root, err := rootElement(body)
+	if err != nil {
+		return ""
+	}
+	switch root {
+	case "rss":
+		return "rss"
+	case "feed":
+		return "atom"
+	}
+	return ""
+}
+
+// rootElement returns the local name of the document's root element, which
+// identifies the feed format without attempting a full unmarshal.
+func rootElement(body []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
+
+// feedItem is an RSS item or Atom entry as processItems sees it, so that
+// both formats share one notify path.
+type feedItem struct {
+	Title, Link, GUID string
+	// Date is the item's date as chosen by the feed's date_fields.
+	Date       string
+	Categories []string
+	Author     string
+	// Source is the title of the feed an aggregator took the item from.
+	Source string
+	// HTML is the item's content, falling back to its summary.
+	HTML              string
+	Raw               string
+	Media, MediaGroup Media
+}
+
+// view returns the item as processItems sees it.
+func (i Item) view(dateFields []string) feedItem {
+	return feedItem{
+		Title:      i.Title,
+		Link:       i.Link,
+		GUID:       i.GUID,
+		Date:       i.date(dateFields),
+		Categories: i.Categories,
+		Author:     i.author(),
+		Source:     strings.TrimSpace(i.Source.Name),
+		HTML:       i.html(),
+		Raw:        i.Raw,
+		Media:      i.Media,
+		MediaGroup: i.MediaGroup,
+	}
+}
+
+// view returns the entry as processItems sees it.
+func (e Entry) view(dateFields []string) feedItem {
+	return feedItem{
+		Title:      e.Title,
+		Link:       e.Link.Href,
+		GUID:       e.ID,
+		Date:       e.date(dateFields),
+		Categories: entryCategories(e),
+		Author:     e.author(),
+		Source:     strings.TrimSpace(e.Source.Title),
+		HTML:       e.html(),
+		Raw:        e.Raw,
+		Media:      e.Media,
+		MediaGroup: e.MediaGroup,
+	}
+}
+
+// key identifies the item within its feed (see itemKey).
+func (i feedItem) key() string {
+	return itemKey(i.GUID, i.Link, i.Title)
+}
+
+// processRSSFeed notifies the feed's new items, counting them in result and
+// returning the errors of any notifications that could not be sent.
+func processRSSFeed(ctx context.Context, feed *Feed, rss Rss, result *FeedResult, logger *log.Entry) error {
+	items := make([]feedItem, len(rss.Channel.Item))
+	for i, item := range rss.Channel.Item {
+		items[i] = item.view(feed.DateFields)
+	}
+	return processItems(ctx, feed, items, feedIcon(feed.URL, rss.Channel.siteLink(), rss.Channel.Image.URL), result, logger)
+}
+
+// processAtomFeed is processRSSFeed for Atom feeds.
+func processAtomFeed(ctx context.Context, feed *Feed, atom Atom, result *FeedResult, logger *log.Entry) error {
+	items := make([]feedItem, len(atom.Entries))
+	for i, entry := range atom.Entries {
+		items[i] = entry.view(feed.DateFields)
+	}
+	return processItems(ctx, feed, items, feedIcon(feed.URL, "", firstNonEmpty(atom.Icon, atom.Logo)), result, logger)
+}
+
+// processItems notifies the new ones of the feed's items, with defaultIcon
+// for items without an image of their own.
+func processItems(ctx context.Context, feed *Feed, items []feedItem, defaultIcon string, result *FeedResult, logger *log.Entry) error {
+	type datedItem struct {
+		item      feedItem
+		published time.Time
+		key       string
+		// changed is set for a seen item whose content changed.
+		changed bool
+	}
+
+	var dated []datedItem
+	clamped := map[string]time.Time{}
+	for _, item := range items {
+		published, err := parseDate(item.Date)
+		if err != nil && feed.DedupMode != "hash" {
+			logger.Errorf("Error parsing date for item in feed: %v", err)
+			continue
+		}
+		published, ok := futureDate(feed, published, item.key(), clamped, logger)
+		if !ok {
+			continue
+		}
+		dated = append(dated, datedItem{item: item, published: published})
+	}
+	feed.clamped = clamped
+
+	sort.SliceStable(dated, func(i, j int) bool {
+		return dated[i].published.Before(dated[j].published)
+	})
+
+	topic := topicFor(feed)
+	result.Parsed = len(items)
+	var errs []error
+	var outgoing []Notification
+	var fresh []datedItem
+	hashes := map[string]string{}
+	lastUpdate := feed.LastUpdate
+	for _, d := range dated {
+		d.key = dedupKey(feed, d.item.GUID, d.item.Link, d.item.Title)
+		isNewItem := isNew(feed, d.key, d.published)
+		d.changed = contentChanged(feed, d.item.key(), d.item.Title, d.item.HTML, hashes)
+		if !isNewItem && !d.changed {
+			continue
+		}
+		if tooOld(feed, d.published) {
+			logger.Debugf("Skipping item older than max_item_age or not_before: %s", d.item.Title)
+			continue
+		}
+		if !itemMatches(feed.Match, d.item.Raw) {
+			logger.Debugf("Skipping item not matching match: %s", d.item.Title)
+			continue
+		}
+		if !feed.Filter.matches(filterItem{title: d.item.Title, author: d.item.Author, content: d.item.HTML, raw: d.item.Raw, categories: d.item.Categories}) {
+			logger.Debugf("Skipping item not matching filter: %s", d.item.Title)
+			continue
+		}
+		fresh = append(fresh, d)
+	}
+	if feed.LastUpdate.After(lastUpdate) {
+		logger.Infof("Updated last published timestamp to %s", feed.LastUpdate)
+	}
+	if feed.NotifyOnContentChange {
+		feed.itemHashes = hashes
+	}
+	result.New = len(fresh)
+	if feed.NewestOnly && len(fresh) > 1 {
+		logger.Debugf("Notifying only the newest of %d new items", len(fresh))
+		fresh = fresh[len(fresh)-1:]
+	}
+	if inStartupGrace() && len(fresh) > 0 {
+		logger.Infof("Not notifying %d new items during startup_grace", len(fresh))
+		fresh = nil
+	}
+
+	for _, d := range fresh {
+		priority := itemPriority(feed, d.item.Title)
+		rule := matchedRule(feed, d.item.Title, d.item.Raw)
+		if rule != nil && rule.Priority > 0 {
+			priority = rule.Priority
+		}
+		data := templateData{Title: d.item.Title, Link: d.item.Link, Feed: feed.URL, Category: firstNonEmpty(d.item.Categories...), Author: d.item.Author, Source: d.item.Source, Published: publishedIn(d.published)}
+		send, err := runExec(feed.Exec, data, logger)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if !send {
+			continue
+		}
+		actions, err := renderActions(feed.Actions, data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error rendering actions: %w", err))
+			continue
+		}
+		groupKey, err := renderTemplate(feed.GroupKey, data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error rendering group_key: %w", err))
+			continue
+		}
+		tags, err := renderTags(feed.Tags, data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error rendering tags: %w", err))
+			continue
+		}
+		n := Notification{
+			Topic:      topic,
+			Token:      feedToken(feed, topic),
+			Feed:       feed.URL,
+			Title:      sourceTitle(feed, d.item.Source, d.item.Title),
+			Link:       d.item.Link,
+			Icon:       firstNonEmpty(feed.Icon, mediaThumbnail(d.item.Media, d.item.MediaGroup), defaultIcon),
+			Attach:     mediaImage(d.item.Media, d.item.MediaGroup),
+			Priority:   priority,
+			Email:      feed.Email,
+			Call:       callFor(feed, priority),
+			Actions:    actions,
+			Tags:       joinTags(groupTag(groupKey), tags),
+			Body:       feedContent(feed, d.item.HTML),
+			SingleLine: feed.SingleLine,
+			Separator:  feed.Separator,
+			LinkFirst:  feed.LinkPosition == "before",
+			MaxBody:    feed.MaxBody,
+			Timeout:    feed.NotifyTimeout,
+		}
+		if err := applyRule(rule, &n, data); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if d.changed {
+			n.Title = "Updated: " + n.Title
+		}
+		hold := throttled(feed)
+		if hold {
+			logger.Debugf("Holding %q for the throttle digest", n.Title)
+		}
+		for _, t := range categoryTopics(feed, topic, d.item.Categories) {
+			n.Topic, n.Token = t, feedToken(feed, t)
+			if hold {
+				feed.held = append(feed.held, n)
+				continue
+			}
+			outgoing = append(outgoing, n)
+		}
+	}
+	errs = append(errs, outbox.send(ctx, feed, outgoing, result, logger)...)
+
+	logger.WithFields(log.Fields{
+		"parsed":  result.Parsed,
+		"new":     result.New,
+		"skipped": result.Parsed - result.New,
+	}).Debug("Processed feed items")
+
+	if feed.NotifyOnRemoval {
+		current := make([]presentItem, 0, len(items))
+		for _, item := range items {
+			current = append(current, presentItem{item.key(), item.Title, item.Link})
+		}
+		errs = append(errs, notifyRemoved(ctx, feed, current, result, logger)...)
+	}
+	return errors.Join(errs...)
+}
+
+// itemKey identifies an item by its GUID, falling back to its link and then
+// its title for feeds that don't provide one.
+func itemKey(guid, link, title string) string {
+	return firstNonEmpty(strings.TrimSpace(guid), strings.TrimSpace(link), title)
+}
+
+// itemMatch is a parsed match expression.
+type itemMatch struct {
+	path []string
+	// op is "" to match any non-empty value, "=", "!=" or "contains".
+	op    string
+	value string
+}
+
+// matchPattern is the syntax of a match expression: a path, optionally
+// compared with = or != to a quoted string, or contains(path, 'string').
+var matchPattern = regexp.MustCompile(`^\s*(?:contains\(\s*([^,\s]+)\s*,\s*(?:'([^']*)'|"([^"]*)")\s*\)|([^=!\s]+)(?:\s*(!?=)\s*(?:'([^']*)'|"([^"]*)"))?)\s*$`)
+
+// parseMatch parses a match expression, a small subset of XPath evaluated
+// against an item or entry:
+//
+//	dc:creator                      the element exists and isn't empty
+//	category = 'Security'           some element's text equals the string
+//	media:content/@medium != 'video'
+//	contains(description, 'CVE-')   some element's text contains the string
+//
+// Paths are element names separated by /, relative to the item, and may
+// end with @attribute. Namespace prefixes are ignored. An empty expression
+// matches every item.
+func parseMatch(expr string) (*itemMatch, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+	m := matchPattern.FindStringSubmatch(expr)
+	if m == nil {
+		return nil, fmt.Errorf("invalid expression %q", expr)
+	}
+	match := &itemMatch{op: "contains", value: m[2] + m[3]}
+	path := m[1]
+	if path == "" {
+		path = m[4]
+		match.op = m[5]
+		match.value = m[6] + m[7]
+	}
+	match.path = strings.Split(path, "/")
+	for i, step := range match.path {
+		if step == "" || (strings.HasPrefix(step, "@") && i != len(match.path)-1) {
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+	}
+	return match, nil
+}
+
+// itemMatches reports whether the item with XML raw matches expr, which
+// loadConfig has already checked.
+func itemMatches(expr, raw string) bool {
+	match, err := parseMatch(expr)
+	if err != nil || match == nil {
+		return err == nil
+	}
+	for _, value := range xmlPathValues(raw, match.path) {
+		switch match.op {
+		case "":
+			if strings.TrimSpace(value) != "" {
+				return true
+			}
+		case "=":
+			if strings.TrimSpace(value) == match.value {
+				return true
+			}
+		case "!=":
+			if strings.TrimSpace(value) != match.value {
+				return true
+			}
+		case "contains":
+			if strings.Contains(value, match.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// xmlPathValues returns the text of the elements, or the values of the
+// attributes, at path in the XML fragment raw.
+func xmlPathValues(raw string, path []string) []string {
+	decoder := xml.NewDecoder(strings.NewReader(raw))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	localName := func(step string) string {
+		if i := strings.LastIndex(step, ":"); i >= 0 {
+			return step[i+1:]
+		}
+		return step
+	}
+	attr := ""
+	if last := path[len(path)-1]; strings.HasPrefix(last, "@") {
+		attr = localName(last[1:])
+		path = path[:len(path)-1]
+	}
+
+	var values []string
+	// depth is the number of open elements, and matched how many of them
+	// match the leading steps of path.
+	depth, matched := 0, 0
+	var text *strings.Builder
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return values
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if matched != depth-1 || matched == len(path) || localName(tok.Name.Local) != localName(path[matched]) {
+				continue
+			}
+			matched++
+			if matched < len(path) {
+				continue
+			}
+			if attr != "" {
+				for _, a := range tok.Attr {
+					if a.Name.Local == attr {
+						values = append(values, a.Value)
+					}
+				}
+			} else {
+				text = &strings.Builder{}
+			}
+		case xml.CharData:
+			if text != nil {
+				text.Write(tok)
+			}
+		case xml.EndElement:
+			if matched == depth {
+				if matched == len(path) && text != nil {
+					values = append(values, text.String())
+					text = nil
+				}
+				matched--
+			}
+			depth--
+		}
+	}
+}
+
+// sourceTitle returns the notification title of an item, prefixed with its
+// source for show_source feeds.
+func sourceTitle(feed *Feed, source, title string) string {
+	if !feed.ShowSource || source == "" {
+		return title
+	}
+	return source + ": " + title
+}
+
+// categoryTopics returns the topics an item in categories is sent to: those
+// category_topics maps its categories to, or topic when none are mapped.
+func categoryTopics(feed *Feed, topic string, categories []string) []string {
+	var topics []string
+	for _, category := range categories {
+		t, ok := feed.CategoryTopics[strings.ToLower(strings.TrimSpace(category))]
+		if ok && !slices.Contains(topics, t) {
+			topics = append(topics, t)
+		}
+	}
+	if len(topics) == 0 {
+		return []string{topic}
+	}
+	return topics
+}
+
+// entryCategories returns the terms of an entry's categories.
+func entryCategories(entry Entry) []string {
+	var terms []string
+	for _, c := range entry.Categories {
+		terms = append(terms, c.Term)
+	}
+	return terms
+}
+
+// groupTag turns a rendered group_key into a single ntfy tag. ntfy separates
+// tags with commas, so they are replaced.
+func groupTag(key string) string {
+	return strings.TrimSpace(strings.ReplaceAll(key, ",", " "))
+}
+
+// renderTags renders the feed's tags against data, each made a valid ntfy
+// tag by ntfyTag. Tags that render empty, such as {{.Category}} for an item
+// without categories, and repeated tags are left out.
+func renderTags(tags []string, data templateData) ([]string, error) {
+	var rendered []string
+	for _, text := range tags {
+		tag, err := renderTemplate(text, data)
+		if err != nil {
+			return nil, err
+		}
+		if tag = ntfyTag(tag); tag != "" && !slices.Contains(rendered, tag) {
+			rendered = append(rendered, tag)
+		}
+	}
+	return rendered, nil
+}
+
+// ntfyTag turns text into a single ntfy tag: lower case, so a tag naming an
+// emoji shows as one, with spaces, control characters and the commas ntfy
+// separates tags with replaced by dashes.
+func ntfyTag(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r) || unicode.IsControl(r)
+	})
+	return strings.Join(words, "-")
+}
+
+// joinTags returns the X-Tags value for a notification with the given
+// group tag, which may be "", and rendered tags.
+func joinTags(group string, tags []string) string {
+	if group != "" {
+		tags = append([]string{group}, tags...)
+	}
+	return strings.Join(tags, ",")
+}
+
+// contentChanged records the content hash of an item's title and content in
+// hashes under key, for notify_on_content_change. It reports whether the
+// item was seen before with other content.
+func contentChanged(feed *Feed, key, title, content string, hashes map[string]string) bool {
+	if !feed.NotifyOnContentChange {
+		return false
+	}
+	hash := contentHash(title, content)
+	hashes[key] = hash
+	previous, seen := feed.itemHashes[key]
+	return seen && previous != hash
+}
+
+// dedupKey returns the key isNew records an item under: its content hash in
+// hash mode, otherwise its itemKey.
+func dedupKey(feed *Feed, guid, link, title string) string {
+	if feed.DedupMode == "hash" {
+		return contentHash(title, link)
+	}
+	return itemKey(guid, link, title)
+}
+
+// notifyRemoved sends a notification for each item of the previous poll that
+// is missing from current, then records current as the feed's item set. An
+// empty current set is treated as a bad response rather than every item
+// having been removed.
+func notifyRemoved(ctx context.Context, feed *Feed, current []presentItem, result *FeedResult, logger *log.Entry) []error {
+	previous := feed.present
+	if len(current) == 0 && len(previous) > 0 {
+		logger.Warn("Feed returned no items, skipping removal check")
+		return nil
+	}
+	feed.present = current
+	if previous == nil {
+		return nil
+	}
+
+	keys := make(map[string]bool, len(current))
+	for _, item := range current {
+		keys[item.Key] = true
+	}
+
+	topic := topicFor(feed)
+	var removed []Notification
+	for _, item := range previous {
+		if keys[item.Key] {
+			continue
+		}
+		removed = append(removed, Notification{
+			Topic:      topic,
+			Token:      feedToken(feed, topic),
+			Feed:       feed.URL,
+			Title:      "Removed: " + item.Title,
+			Link:       item.Link,
+			Icon:       feed.Icon,
+			Priority:   feed.Priority,
+			Email:      feed.Email,
+			SingleLine: feed.SingleLine,
+			Separator:  feed.Separator,
+			LinkFirst:  feed.LinkPosition == "before",
+			MaxBody:    feed.MaxBody,
+			Timeout:    feed.NotifyTimeout,
+		})
+	}
+	return outbox.send(ctx, feed, removed, result, logger)
+}
+
+// isNew reports whether the item identified by key should be notified,
+// recording it in the feed's state. In bloom and hash mode the first poll
+// only populates the seen set, apart from items within the feed's
+// bootstrap_since window.
+func isNew(feed *Feed, key string, published time.Time) bool {
+	if feed.DedupMode != "bloom" && feed.DedupMode != "hash" {
+		if published.After(feed.LastUpdate) {
+			feed.LastUpdate = published
+			return true
+		}
+		return false
+	}
+
+	var seen interface {
+		Test(key string) bool
+		Add(key string)
+	}
+	if feed.DedupMode == "hash" {
+		if feed.hashes == nil {
+			feed.hashes = newHashSet(nil)
+		}
+		seen = feed.hashes
+	} else {
+		if feed.seen == nil {
+			feed.seen = newFeedBloomFilter(feed)
+		}
+		seen = feed.seen
+	}
+
+	recent := published.After(feed.LastUpdate)
+	if recent {
+		feed.LastUpdate = published
+	}
+	if seen.Test(key) {
+		return false
+	}
+	seen.Add(key)
+	return feed.primed || (feed.BootstrapSince > 0 && recent)
 }
 
-type Channel struct {
-	Title string `xml:"title"`
-	Item  []Item `xml:"item"`
+// futureDate applies the feed's future_dates setting to an item dated after
+// now, as happens with feeds whose clock is ahead. Left as is, such a date
+// moves LastUpdate ahead and hides the feed's next items until it has
+// passed. "clamp" treats the item as published when it was first seen, for
+// as long as it stays in the feed, recording that in clamped. "skip"
+// ignores the item until its date arrives; ok is false for a skipped item.
+func futureDate(feed *Feed, published time.Time, key string, clamped map[string]time.Time, logger *log.Entry) (time.Time, bool) {
+	if first, ok := feed.clamped[key]; ok {
+		clamped[key] = first
+		return first, true
+	}
+	now := clock.Now()
+	if !published.After(now) {
+		return published, true
+	}
+	switch feed.FutureDates {
+	case "clamp":
+		logger.Debugf("Treating item dated %s in the future as published now", published.Sub(now).Round(time.Second))
+		clamped[key] = now
+		return now, true
+	case "skip":
+		logger.Warnf("Skipping item dated %s in the future", published.Sub(now).Round(time.Second))
+		return published, false
+	}
+	return published, true
 }
 
-type Item struct {
-	Title     string `xml:"title"`
-	Link      string `xml:"link"`
-	Published string `xml:"pubDate"`
+// tooOld reports whether an item published at published is older than the
+// feed's max_item_age or not_before. Items without a date are never too old.
+func tooOld(feed *Feed, published time.Time) bool {
+	if published.IsZero() {
+		return false
+	}
+	if !feed.NotBefore.IsZero() && published.Before(feed.NotBefore) {
+		return true
+	}
+	return feed.MaxItemAge > 0 && clock.Now().Sub(published) > feed.MaxItemAge
 }
 
-type Atom struct {
-	XMLName xml.Name `xml:"feed"`
-	Title   string   `xml:"title"`
-	Entries []Entry  `xml:"entry"`
+// itemPriority returns the highest priority among the feed's keywords found
+// in title, or the feed's default priority when none match.
+func itemPriority(feed *Feed, title string) int {
+	priority := 0
+	lower := strings.ToLower(title)
+	for keyword, p := range feed.PriorityKeywords {
+		if p > priority && strings.Contains(lower, strings.ToLower(keyword)) {
+			priority = p
+		}
+	}
+	if priority == 0 {
+		return feed.Priority
+	}
+	return priority
 }
 
-type Entry struct {
-	Title     string `xml:"title"`
-	Link      Link   `xml:"link"`
-	Published string `xml:"published"`
-}
+// feedIcon returns the icon advertised by a feed, falling back to the
+// /favicon.ico of the feed's site (or of the feed URL itself).
+func feedIcon(feedURL, siteURL, image string) string {
+	if image != "" {
+		return image
+	}
 
-type Link struct {
-	Href string `xml:"href,attr"`
+	u, err := url.Parse(firstNonEmpty(siteURL, feedURL))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + "/favicon.ico"
 }
 
-type Feed struct {
-	URL        string `yaml:"url"`
-	NtfyTopic  string `yaml:"ntfy_topic"`
-	LastUpdate time.Time
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
 }
 
-type Config struct {
-	Feeds []Feed `yaml:"feeds"`
+// dateFormats are the layouts parseDate tries, in order. Layouts carrying a
+// time zone come before the zoneless ones that would otherwise match a prefix
+// of the same string.
+var dateFormats = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822,
+	time.RFC822Z,
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05.999999Z07:00",
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	time.RFC850,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
 }
 
-func main() {
-	log.SetFormatter(&log.JSONFormatter{
-		TimestampFormat: "2006-01-02 15:04:05",
-	})
+func parseDate(dateString string) (time.Time, error) {
+	t, _, err := matchDateFormat(dateString)
+	return t, err
+}
 
-	var intervalFlag string
-	var configFile string
+// matchDateFormat parses dateString with the first matching layout in
+// dateFormats, returning the layout that matched.
+func matchDateFormat(dateString string) (time.Time, string, error) {
+	dateString = strings.TrimSpace(dateString)
+	for _, format := range dateFormats {
+		if t, err := time.Parse(format, dateString); err == nil {
+			return t, format, nil
+		}
+	}
 
-	flag.StringVar(&intervalFlag, "interval", "10m", "Check interval (e.g., 30s, 20m, 2h)")
-	flag.StringVar(&configFile, "config", "", "Path to config file")
-	flag.Parse()
+	return time.Time{}, "", fmt.Errorf("unable to parse date: %s", dateString)
+}
 
-	if intervalFlag == "" || configFile == "" {
-		fmt.Fprintf(os.Stderr, "Usage: %s -interval <duration> [-config <path>]\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		flag.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nExample:\n")
-		fmt.Fprintf(os.Stderr, "  %s -interval 10m -config /path/to/feeds.yaml\n", os.Args[0])
-		os.Exit(1)
+func newTokenBucket(rl RateLimitConfig) *tokenBucket {
+	burst := rl.Burst
+	if burst <= 0 {
+		burst = rl.Notifications
+	}
+	b := &tokenBucket{
+		tokens: float64(burst),
+		burst:  float64(burst),
+		last:   clock.Now(),
 	}
+	b.rate = float64(rl.Notifications) / rl.period().Seconds()
+	return b
+}
 
-	interval, err := time.ParseDuration(intervalFlag)
-	if err != nil {
-		log.Fatalf("Invalid interval format: %v", err)
+func (rl RateLimitConfig) period() time.Duration {
+	if rl.Period <= 0 {
+		return time.Minute
 	}
+	return rl.Period
+}
 
-	log.Info("Reading config file")
-	config, err := loadConfig(configFile)
-	if err != nil {
-		log.Fatalf("Error loading config: %v", err)
+// wait blocks until a token is available and takes it.
+func (b *tokenBucket) wait(logger *log.Entry) {
+	for {
+		b.mu.Lock()
+		now := clock.Now()
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return
+		}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		logger.Debugf("Notification rate limit reached, waiting %v", delay)
+		clock.Sleep(delay)
 	}
-	log.Infof("Using check interval: %v", interval)
+}
 
-	client := &http.Client{
-		Timeout: time.Second * 30,
+// breakerFor returns the circuit breaker for the ntfy server hosting topic.
+func breakerFor(topic string) (*circuitBreaker, string) {
+	server := serverOf(topic)
+
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	cb, ok := breakers[server]
+	if !ok {
+		cb = &circuitBreaker{}
+		breakers[server] = cb
 	}
+	return cb, server
+}
 
-	for {
-		processFeedsAsync(config.Feeds, client)
-		log.Infof("Sleeping for %v", interval)
-		time.Sleep(interval)
+// allow reports whether a send may be attempted. When the cooldown of an open
+// breaker has elapsed, a single trial send is allowed and the breaker stays
+// open for another cooldown until that send is recorded.
+func (cb *circuitBreaker) allow(logger *log.Entry) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.failures < breakerConfig.Failures {
+		return true
+	}
+	now := clock.Now()
+	if now.Before(cb.openUntil) {
+		return false
 	}
+	logger.Info("Circuit breaker half-open, trying a notification")
+	cb.openUntil = now.Add(breakerConfig.Cooldown)
+	return true
 }
 
-func processFeedsAsync(feeds []Feed, client *http.Client) {
-	var wg sync.WaitGroup
+func (cb *circuitBreaker) record(success bool, logger *log.Entry) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
 
-	for i := range feeds {
-		wg.Add(1)
-		go func(feed *Feed) {
-			defer wg.Done()
-			processFeed(feed, client)
-		}(&feeds[i])
+	if success {
+		if cb.failures >= breakerConfig.Failures {
+			logger.Info("Circuit breaker closed")
+		}
+		cb.failures = 0
+		return
 	}
 
-	wg.Wait()
+	cb.failures++
+	if cb.failures >= breakerConfig.Failures {
+		cb.openUntil = clock.Now().Add(breakerConfig.Cooldown)
+		logger.Warnf("Circuit breaker open after %d consecutive failures, skipping sends for %v", cb.failures, breakerConfig.Cooldown)
+	}
 }
 
-func loadConfig(filename string) (*Config, error) {
-	filename = expandTilde(filename)
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, fmt.Errorf("error reading config file: %w", err)
+// Notifier delivers notifications to a backend. Failures that got a
+// response from the backend should be returned as a *SendError carrying its
+// status, which decides whether they are retried and how they count against
+// the circuit breaker.
+type Notifier interface {
+	Send(ctx context.Context, n Notification) error
+}
+
+// notifier is the backend sendNotification delivers to.
+var notifier Notifier = NtfyNotifier{}
+
+// sendNotification sends n through notifier, applying the rate limit and
+// the circuit breaker of its server. It returns a *SendError if it fails.
+func sendNotification(ctx context.Context, n Notification, logger *log.Entry) error {
+	if notifyLimiter != nil {
+		notifyLimiter.wait(logger)
 	}
 
-	var config Config
-	err = yaml.Unmarshal(data, &config)
+	cb, server := breakerFor(n.Topic)
+	breakerLogger := logger.WithField("server", server)
+	if !cb.allow(breakerLogger) {
+		err := fmt.Errorf("circuit breaker open for %s, skipping notification", server)
+		sendFailures.add(n.Topic, 0)
+		return &SendError{Topic: n.Topic, Err: err}
+	}
+
+	err := notifier.Send(ctx, n)
+	var sendErr *SendError
+	if err != nil && !errors.As(err, &sendErr) {
+		sendErr = &SendError{Topic: n.Topic, Err: err}
+	}
+	// Only a failure without a response, or a server error, suggests the
+	// server is down.
+	cb.record(err == nil || (sendErr.Status > 0 && sendErr.Status < http.StatusInternalServerError), breakerLogger)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing config file: %w", err)
+		sendFailures.add(n.Topic, sendErr.Status)
+		return sendErr
 	}
+	logger.Infof("Notification sent:\n\n%s", n.message())
+	return nil
+}
 
-	now := time.Now()
-	for i := range config.Feeds {
-		config.Feeds[i].LastUpdate = now
+// SendError is a notification that failed to send. Status is the HTTP
+// status of the ntfy server's response, or 0 if there was none.
+type SendError struct {
+	Topic  string
+	Status int
+	Err    error
+}
+
+func (e *SendError) Error() string { return e.Err.Error() }
+
+func (e *SendError) Unwrap() error { return e.Err }
+
+// sendFailureKey identifies a count in failureCounter.
+type sendFailureKey struct {
+	topic  string
+	status int
+}
+
+// failureCounter counts failed sends by topic and HTTP status.
+type failureCounter struct {
+	mu     sync.Mutex
+	counts map[sendFailureKey]int
+}
+
+// sendFailures counts every failed send since startup, for the status file.
+var sendFailures = &failureCounter{counts: map[sendFailureKey]int{}}
+
+func (c *failureCounter) add(topic string, status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[sendFailureKey{topic, status}]++
+}
+
+// lines formats the counts as status file lines, sorted by topic and status.
+func (c *failureCounter) lines() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]sendFailureKey, 0, len(c.counts))
+	for key := range c.counts {
+		keys = append(keys, key)
 	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].topic != keys[j].topic {
+			return keys[i].topic < keys[j].topic
+		}
+		return keys[i].status < keys[j].status
+	})
+	lines := make([]string, len(keys))
+	for i, key := range keys {
+		lines[i] = fmt.Sprintf("topic=%s status=%d send_failures=%d", key.topic, key.status, c.counts[key])
+	}
+	return lines
+}
 
-	return &config, nil
+// NtfyNotifier publishes notifications to ntfy topics. A nil Client means
+// notifyClient.
+type NtfyNotifier struct {
+	Client *http.Client
 }
 
-func expandTilde(path string) string {
-	if strings.HasPrefix(path, "~") {
-		home, err := os.UserHomeDir()
-		if err != nil {
-			return path
+// singleLineSeparator joins the parts of a single_line notification.
+const singleLineSeparator = " — "
+
+// message returns the text of the notification: the title, then the body
+// and the link when there are any, or the link first with LinkFirst.
+func (n Notification) message() string {
+	if n.Message != "" {
+		return truncateRunes(n.Message, n.MaxBody)
+	}
+	separator := "\n\n"
+	if n.SingleLine {
+		separator = singleLineSeparator
+	}
+	if n.Separator != "" {
+		separator = n.Separator
+	}
+
+	parts := []string{n.Title}
+	if n.Body != "" {
+		body := n.Body
+		if n.SingleLine {
+			body = strings.Join(strings.Fields(body), " ")
 		}
-		return filepath.Join(home, path[1:])
+		parts = []string{markdownEscape(n.Title), body}
 	}
-	return path
+	if n.Link != "" {
+		if n.LinkFirst {
+			parts = append([]string{n.Link}, parts...)
+		} else {
+			parts = append(parts, n.Link)
+		}
+	}
+	return truncateRunes(strings.Join(parts, separator), n.MaxBody)
 }
 
-func processFeed(feed *Feed, client *http.Client) {
-	logger := log.WithFields(log.Fields{"feed": feed.URL})
-	logger.Infof("Checking feed")
+// truncateRunes shortens s to at most limit runes, ending it with an
+// ellipsis when anything was cut. A limit of 0 means no limit.
+func truncateRunes(s string, limit int) string {
+	if limit <= 0 || utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:limit-1]) + "…"
+}
 
-	req, err := http.NewRequest("GET", feed.URL, nil)
+func (ntfy NtfyNotifier) Send(ctx context.Context, n Notification) error {
+	req, err := ntfyRequest(ctx, n)
 	if err != nil {
-		logger.Errorf("Error creating request: %v", err)
-		return
+		return err
 	}
 
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
-	resp, err := client.Do(req)
+	client := ntfy.Client
+	if client == nil {
+		client = notifyClient
+	}
+	resp, err := withTimeout(client, n.Timeout).Do(req)
 	if err != nil {
-		logger.Errorf("Error fetching feed: %v", err)
-		return
+		return fmt.Errorf("error sending notification: %w", err)
 	}
 	defer resp.Body.Close()
 
-	logger.Infof("Response status code: %d", resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("failed to send notification: %s", resp.Status)
+		if resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests {
+			// The server rejected the notification; sending it again
+			// won't help.
+			err = fmt.Errorf("%w: %w", errRejected, err)
+		}
+		return &SendError{Topic: n.Topic, Status: resp.StatusCode, Err: err}
+	}
+	return nil
+}
 
-	body, err := io.ReadAll(resp.Body)
+// ntfyRequest returns the ntfy request publishing n.
+func ntfyRequest(ctx context.Context, n Notification) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", n.Topic, strings.NewReader(n.message()))
 	if err != nil {
-		logger.Errorf("Error reading feed: %v", err)
-		return
+		return nil, fmt.Errorf("error creating notification request: %w", err)
 	}
 
-	var rss Rss
-	var atom Atom
-	var isAtom bool
+	req.Header.Set("Content-Type", "text/plain")
+	if token := tokenFor(n.Topic, n.Token); token != "" {
+		req.Header.Set("Authorization", authorizationHeader(token))
+	}
+	if n.Link != "" {
+		req.Header.Set("X-Click", n.Link)
+	}
+	if n.Icon != "" {
+		req.Header.Set("X-Icon", n.Icon)
+	}
+	if n.Attach != "" {
+		req.Header.Set("X-Attach", n.Attach)
+	}
+	if n.Priority > 0 {
+		req.Header.Set("X-Priority", strconv.Itoa(n.Priority))
+	}
+	if n.Email != "" {
+		req.Header.Set("X-Email", n.Email)
+	}
+	if n.Call != "" {
+		req.Header.Set("X-Call", n.Call)
+	}
+	if n.Actions != "" {
+		req.Header.Set("X-Actions", n.Actions)
+	}
+	if n.Tags != "" {
+		req.Header.Set("X-Tags", n.Tags)
+	}
+	if n.Body != "" {
+		req.Header.Set("X-Markdown", "yes")
+	}
+	return req, nil
+}
 
-	if err := xml.Unmarshal(body, &rss); err != nil {
-		if err := xml.Unmarshal(body, &atom); err != nil {
-			logger.Errorf("Error parsing feed: %v", err)
-			return
+// throttled reports whether the feed's next notification must be held for
+// its throttle digest. Otherwise it starts a new throttle window.
+func throttled(feed *Feed) bool {
+	if feed.Throttle <= 0 {
+		return false
+	}
+	now := clock.Now()
+	if len(feed.held) > 0 || (!feed.lastNotified.IsZero() && now.Sub(feed.lastNotified) < feed.Throttle) {
+		return true
+	}
+	feed.lastNotified = now
+	return false
+}
+
+// sendDigest sends the notifications the feed has held once its throttle
+// window is over, as one notification per topic listing them. A topic's
+// token follows from the topic (see feedToken), so each digest goes with the
+// token its notifications would have.
+func sendDigest(ctx context.Context, feed *Feed, result *FeedResult, logger *log.Entry) error {
+	if len(feed.held) == 0 || clock.Now().Sub(feed.lastNotified) < feed.Throttle {
+		return nil
+	}
+
+	var topics []string
+	byTopic := map[string][]Notification{}
+	for _, n := range feed.held {
+		if _, ok := byTopic[n.Topic]; !ok {
+			topics = append(topics, n.Topic)
 		}
-		isAtom = true
+		byTopic[n.Topic] = append(byTopic[n.Topic], n)
 	}
 
-	if isAtom {
-		logger.Infof("Processing as Atom feed")
-		processAtomFeed(feed, atom, logger)
-	} else {
-		logger.Info("Processing as RSS feed")
-		processRSSFeed(feed, rss, logger)
+	var digests []Notification
+	for _, topic := range topics {
+		held := byTopic[topic]
+		digest := Notification{
+			Topic:   topic,
+			Token:   feedToken(feed, topic),
+			Feed:    feed.URL,
+			Title:   fmt.Sprintf("%d new items", len(held)),
+			Icon:    feed.Icon,
+			Email:   feed.Email,
+			Timeout: feed.NotifyTimeout,
+		}
+		var lines []string
+		for _, n := range held {
+			digest.Priority = max(digest.Priority, n.Priority)
+			line := "- " + markdownEscape(n.Title)
+			if n.Link != "" {
+				line = fmt.Sprintf("- [%s](%s)", markdownEscape(n.Title), n.Link)
+			}
+			lines = append(lines, line)
+		}
+		digest.Body = strings.Join(lines, "\n")
+		digests = append(digests, digest)
 	}
+	feed.held = nil
+	feed.lastNotified = clock.Now()
+	return errors.Join(outbox.send(ctx, feed, digests, result, logger)...)
 }
 
-func processRSSFeed(feed *Feed, rss Rss, logger *log.Entry) {
-	for _, item := range rss.Channel.Item {
-		published, err := parseDate(item.Published)
-		if err != nil {
-			logger.Errorf("Error parsing date for item in feed: %v", err)
-			continue
+// notifyOutbox holds the notifications checks have handed over until they
+// are sent. It is saved in the state file, so a check records its items as
+// seen as soon as their notifications are in the outbox: a notification
+// still there after a restart is sent then. Each notification leaves once
+// its send completes, or stays to be sent again on the next check if it
+// failed and isn't dead-lettered instead.
+type notifyOutbox struct {
+	mu sync.Mutex
+	// changed is signalled whenever an item is added or its send ends.
+	changed sync.Cond
+	items   []*outboxItem
+	// workers is the number of notification workers; with none, the
+	// notifications are sent by whoever hands them over.
+	workers int
+	// capture, if set, receives the notifications handed over instead of
+	// them being sent, bypassing the rate limit, circuit breakers and
+	// failure counts of real sends. Previews use it.
+	capture func(Notification)
+}
+
+// outboxItem is a notification in the outbox. feed, if known, is the feed
+// whose statistics count it once it is sent.
+type outboxItem struct {
+	n       Notification
+	feed    *Feed
+	sending bool
+	// failed is set when the send failed, until the next check makes the
+	// notification due again.
+	failed bool
+}
+
+// outbox is where checks hand over their notifications.
+var outbox = newNotifyOutbox()
+
+func newNotifyOutbox() *notifyOutbox {
+	o := &notifyOutbox{}
+	o.changed.L = &o.mu
+	return o
+}
+
+// startNotifyWorkers starts the workers that send notifications, so feed
+// processing goes on while slow sends drain. The workers share the outbox,
+// each taking the oldest notification no other worker has taken, so with
+// more than one worker notifications may arrive out of order.
+func startNotifyWorkers(workers int) {
+	outbox.mu.Lock()
+	outbox.workers += workers
+	outbox.mu.Unlock()
+	for range workers {
+		go outbox.work()
+	}
+}
+
+// work sends the outbox's notifications as they become due.
+func (o *notifyOutbox) work() {
+	for {
+		o.mu.Lock()
+		item := o.next()
+		for item == nil {
+			o.changed.Wait()
+			item = o.next()
 		}
+		item.sending = true
+		o.mu.Unlock()
 
-		if published.After(feed.LastUpdate) {
-			feed.LastUpdate = published
-			sendNotification(feed.NtfyTopic, item.Title, item.Link, logger)
+		o.deliver(item)
+	}
+}
+
+// deliver sends item, counting it in its feed's statistics once it is sent.
+func (o *notifyOutbox) deliver(item *outboxItem) {
+	err := notify(context.Background(), item.n, log.WithField("feed", item.n.Feed))
+	if err == nil && item.feed != nil {
+		statsMu.Lock()
+		item.feed.notified++
+		statsMu.Unlock()
+	}
+	o.done(item, retryLater(err))
+}
+
+// next returns the oldest item that is due to be sent, or nil. o.mu must be
+// held.
+func (o *notifyOutbox) next() *outboxItem {
+	for _, item := range o.items {
+		if !item.sending && !item.failed {
+			return item
 		}
 	}
+	return nil
+}
+
+// retryLater reports whether a notification whose send ended with err stays
+// in the outbox for the next check: it failed, wasn't rejected, and wasn't
+// dead-lettered.
+func retryLater(err error) bool {
+	return err != nil && deadLetters == nil && !errors.Is(err, errRejected)
+}
+
+// done ends the send of item, keeping it for the next check if keep is set
+// and removing it from the outbox otherwise.
+func (o *notifyOutbox) done(item *outboxItem, keep bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	item.sending = false
+	if keep {
+		item.failed = true
+	} else {
+		o.items = slices.DeleteFunc(o.items, func(i *outboxItem) bool { return i == item })
+	}
+	o.changed.Broadcast()
 }
 
-func processAtomFeed(feed *Feed, atom Atom, logger *log.Entry) {
-	for _, entry := range atom.Entries {
-		published, err := parseDate(entry.Published)
+// send hands the notifications of a check of feed to the outbox. With
+// workers running it returns straight away. Without, it sends them itself,
+// giving up once ctx is done, and counts the ones sent in result; a
+// notification of a check given up on doesn't stay in the outbox, as the
+// check is made again.
+func (o *notifyOutbox) send(ctx context.Context, feed *Feed, ns []Notification, result *FeedResult, logger *log.Entry) []error {
+	if len(ns) == 0 {
+		return nil
+	}
+	if o.capture != nil {
+		for _, n := range ns {
+			o.capture(n)
+		}
+		return nil
+	}
+	o.mu.Lock()
+	workers := o.workers
+	items := make([]*outboxItem, len(ns))
+	for i, n := range ns {
+		items[i] = &outboxItem{n: n, feed: feed, sending: workers == 0}
+	}
+	o.items = append(o.items, items...)
+	o.mu.Unlock()
+	if workers > 0 {
+		o.changed.Broadcast()
+		return nil
+	}
+
+	var errs []error
+	for _, item := range items {
+		err := notify(ctx, item.n, logger)
+		o.done(item, retryLater(err) && ctx.Err() == nil)
 		if err != nil {
-			logger.Errorf("Error parsing date for entry in feed: %v", err)
+			errs = append(errs, err)
 			continue
 		}
+		result.Notified++
+	}
+	return errs
+}
 
-		if published.After(feed.LastUpdate) {
-			feed.LastUpdate = published
-			logger.Infof("Updated last published timestamp for: %s", feed.LastUpdate)
-			sendNotification(feed.NtfyTopic, entry.Title, entry.Link.Href, logger)
+// retry makes the notifications whose send failed, and those restored from
+// the state file, due again. Each gets the token of its feed among feeds,
+// as the state file doesn't keep it. Without workers running, they are sent
+// before retry returns.
+func (o *notifyOutbox) retry(feeds []Feed) {
+	byURL := map[string]*Feed{}
+	for i := range feeds {
+		byURL[feeds[i].URL] = &feeds[i]
+	}
+
+	o.mu.Lock()
+	var due []*outboxItem
+	for _, item := range o.items {
+		if !item.failed {
+			continue
 		}
+		if feed, ok := byURL[item.n.Feed]; ok {
+			item.feed = feed
+			item.n.Token = feedToken(feed, item.n.Topic)
+		}
+		item.failed = false
+		item.sending = o.workers == 0
+		due = append(due, item)
+	}
+	workers := o.workers
+	o.mu.Unlock()
+	if workers > 0 {
+		o.changed.Broadcast()
+		return
+	}
+
+	for _, item := range due {
+		o.deliver(item)
 	}
 }
 
-func parseDate(dateString string) (time.Time, error) {
-	formats := []string{
-		time.RFC1123Z,
-		time.RFC1123,
-		time.RFC822,
-		time.RFC822Z,
-		"2006-01-02T15:04:05Z07:00",
-		"2006-01-02 15:04:05",
-		"2006-01-02T15:04:05.999999Z07:00",
-		"Mon, 2 Jan 2006 15:04:05 -0700",
+// drain waits until no notification in the outbox is due or being sent.
+func (o *notifyOutbox) drain() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for slices.ContainsFunc(o.items, func(item *outboxItem) bool { return item.sending || !item.failed }) {
+		o.changed.Wait()
 	}
+}
 
-	for _, format := range formats {
-		if t, err := time.Parse(format, dateString); err == nil {
-			return t, nil
+// pending returns the notifications in the outbox, for the state file.
+func (o *notifyOutbox) pending() []Notification {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ns := make([]Notification, len(o.items))
+	for i, item := range o.items {
+		ns[i] = item.n
+	}
+	return ns
+}
+
+// restore puts notifications saved in the state file back in the outbox,
+// to be sent on the next check.
+func (o *notifyOutbox) restore(ns []Notification) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, n := range ns {
+		o.items = append(o.items, &outboxItem{n: n, failed: true})
+	}
+}
+
+// errRejected marks a notification the ntfy server refused with a 4xx status
+// other than 429. Such sends are not retried.
+var errRejected = errors.New("notification rejected")
+
+// sendWithRetry sends n, trying again per notifyRetry while the failure is
+// not a rejection.
+func sendWithRetry(ctx context.Context, n Notification, logger *log.Entry) error {
+	backoff := notifyRetry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := sendNotification(ctx, n, logger)
+		if err == nil || attempt >= notifyRetry.Attempts || errors.Is(err, errRejected) {
+			return err
+		}
+		logger.Warnf("Sending notification failed, retrying in %v: %v", backoff, err)
+		clock.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// notify sends n, queueing it for redelivery when dead-lettering is enabled
+// and the send fails. A notification the server rejected would be rejected
+// again, so it isn't queued, and neither is one whose check was given up on,
+// as the check is made again.
+func notify(ctx context.Context, n Notification, logger *log.Entry) error {
+	err := sendWithRetry(ctx, n, logger)
+	if err != nil && deadLetters != nil && !errors.Is(err, errRejected) && ctx.Err() == nil {
+		deadLetters.add(deadLetter{Notification: n, Attempts: 1})
+	}
+	return err
+}
+
+// deadLetter is a notification that could not be sent.
+type deadLetter struct {
+	Notification Notification `json:"notification"`
+	Attempts     int          `json:"attempts"`
+}
+
+// deadLetterQueue holds notifications that failed to send so they can be
+// retried on the next check.
+type deadLetterQueue struct {
+	mu    sync.Mutex
+	items []deadLetter
+}
+
+// deadLetters is nil when dead-lettering is disabled.
+var deadLetters *deadLetterQueue
+
+func (q *deadLetterQueue) add(d deadLetter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, d)
+}
+
+// redeliver tries to send every queued notification once, keeping those that
+// fail again until they have been redelivered notifyRetry.Redeliveries times.
+// During an outage the queue waits: once a server can't be reached, its
+// other notifications are kept without trying them, and failures without a
+// response don't count as redeliveries. Each notification is sent with the
+// token of its feed among feeds, as the dead-letter file doesn't keep it.
+func (q *deadLetterQueue) redeliver(feeds []Feed) {
+	q.mu.Lock()
+	pending := q.items
+	q.items = nil
+	q.mu.Unlock()
+
+	byURL := map[string]*Feed{}
+	for i := range feeds {
+		byURL[feeds[i].URL] = &feeds[i]
+	}
+
+	unreachable := map[string]bool{}
+	for _, d := range pending {
+		logger := log.WithField("topic", d.Notification.Topic)
+		if feed, ok := byURL[d.Notification.Feed]; ok {
+			d.Notification.Token = feedToken(feed, d.Notification.Topic)
+		}
+		_, server := breakerFor(d.Notification.Topic)
+		if unreachable[server] {
+			q.add(d)
+			continue
+		}
+		err := sendNotification(context.Background(), d.Notification, logger)
+		if err == nil {
+			continue
 		}
+		var sendErr *SendError
+		if errors.As(err, &sendErr) && sendErr.Status == 0 {
+			logger.Warnf("Redelivery of notification %q failed, keeping %s's notifications queued: %v", d.Notification.Title, server, err)
+			unreachable[server] = true
+			q.add(d)
+			continue
+		}
+		if errors.Is(err, errRejected) {
+			logger.Errorf("Dropping notification %q the server rejected: %v", d.Notification.Title, err)
+			continue
+		}
+		d.Attempts++
+		if d.Attempts > notifyRetry.Redeliveries {
+			logger.Errorf("Dropping notification %q after %d attempts: %v", d.Notification.Title, d.Attempts, err)
+			continue
+		}
+		logger.Warnf("Redelivery of notification %q failed: %v", d.Notification.Title, err)
+		q.add(d)
+	}
+}
+
+// loadDeadLetters reads the dead-letter file, returning an empty queue if it
+// does not exist yet.
+func loadDeadLetters(filename string) (*deadLetterQueue, error) {
+	data, err := os.ReadFile(expandTilde(filename))
+	if os.IsNotExist(err) {
+		return &deadLetterQueue{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading dead-letter file: %w", err)
 	}
 
-	return time.Time{}, fmt.Errorf("unable to parse date: %s", dateString)
+	var q deadLetterQueue
+	if err := json.Unmarshal(data, &q.items); err != nil {
+		return nil, fmt.Errorf("error parsing dead-letter file: %w", err)
+	}
+	return &q, nil
 }
 
-func sendNotification(topic, title, link string, logger *log.Entry) {
-	message := fmt.Sprintf("%s\n\n%s", title, link)
-	resp, err := http.Post(topic, "text/plain", bytes.NewBuffer([]byte(message)))
+// save writes the queued notifications to filename. Their tokens are left
+// out, and looked up again from the feeds on redelivery.
+func (q *deadLetterQueue) save(filename string) error {
+	q.mu.Lock()
+	data, err := json.Marshal(q.items)
+	q.mu.Unlock()
 	if err != nil {
-		logger.Errorf("Error sending notification: %v", err)
-		return
+		return fmt.Errorf("error encoding dead letters: %w", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		logger.Errorf("Failed to send notification: %s", resp.Status)
-	} else {
-		logger.Infof("Notification sent:\n\n%s", message)
+	if err := writeFileAtomic(expandTilde(filename), data); err != nil {
+		return fmt.Errorf("error writing dead-letter file: %w", err)
 	}
+	return nil
 }
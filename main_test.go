@@ -0,0 +1,2694 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// useFakeClock replaces the package clock for the duration of a test.
+func useFakeClock(t *testing.T, now time.Time) *FakeClock {
+	t.Helper()
+	fake := NewFakeClock(now)
+	clock = fake
+	t.Cleanup(func() { clock = realClock{} })
+	return fake
+}
+
+// rssServer serves an RSS document built from items and counts requests.
+func rssServer(t *testing.T, items string) (*httptest.Server, *int) {
+	t.Helper()
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		fmt.Fprintf(w, "<rss><channel><title>Test</title>%s</channel></rss>", items)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+// ntfyServer records the bodies of the notifications it receives.
+func ntfyServer(t *testing.T) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var messages []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		messages = append(messages, string(body))
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), messages...)
+	}
+}
+
+// writeConfig writes a feeds.yaml with the given contents to a temporary
+// directory and returns its path.
+func writeConfig(t *testing.T, config string) string {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "feeds.yaml")
+	if err := os.WriteFile(configFile, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return configFile
+}
+
+func rssItem(title string, published time.Time) string {
+	return fmt.Sprintf("<item><title>%s</title><link>https://example.com/%s</link><pubDate>%s</pubDate></item>",
+		title, title, published.Format(time.RFC1123Z))
+}
+
+func TestTokenBucketWaitsOnClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fake := useFakeClock(t, start)
+
+	bucket := newTokenBucket(RateLimitConfig{Notifications: 1, Period: time.Minute, Burst: 1})
+	logger := log.NewEntry(log.StandardLogger())
+
+	bucket.wait(logger)
+	if got := fake.Now(); !got.Equal(start) {
+		t.Fatalf("first wait advanced the clock to %v", got)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		bucket.wait(logger)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("second wait did not return on the fake clock")
+	}
+
+	if waited := fake.Now().Sub(start); waited < time.Minute {
+		t.Errorf("second wait advanced the clock by %v, want at least 1m", waited)
+	}
+}
+
+func TestCircuitBreakerCooldown(t *testing.T) {
+	fake := useFakeClock(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	saved := breakerConfig
+	breakerConfig = CircuitBreakerConfig{Failures: 2, Cooldown: time.Minute}
+	t.Cleanup(func() { breakerConfig = saved })
+
+	cb := &circuitBreaker{}
+	logger := log.NewEntry(log.StandardLogger())
+
+	cb.record(false, logger)
+	if !cb.allow(logger) {
+		t.Fatal("breaker opened before reaching the failure threshold")
+	}
+	cb.record(false, logger)
+	if cb.allow(logger) {
+		t.Fatal("breaker allowed a send right after opening")
+	}
+
+	fake.Advance(30 * time.Second)
+	if cb.allow(logger) {
+		t.Fatal("breaker allowed a send before the cooldown elapsed")
+	}
+
+	fake.Advance(31 * time.Second)
+	if !cb.allow(logger) {
+		t.Fatal("breaker did not allow a trial send after the cooldown")
+	}
+	if cb.allow(logger) {
+		t.Fatal("breaker allowed a second send while the trial is pending")
+	}
+
+	cb.record(true, logger)
+	if !cb.allow(logger) {
+		t.Fatal("breaker did not close after a successful trial send")
+	}
+}
+
+func TestMinIntervalSkipsPolls(t *testing.T) {
+	fake := useFakeClock(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	srv, requests := rssServer(t, "")
+
+	feeds := []Feed{{URL: srv.URL, NtfyTopic: "http://ntfy.invalid/test", MinInterval: time.Hour}}
+	client := srv.Client()
+
+	processFeedsAsync(feeds, client)
+	fake.Advance(10 * time.Minute)
+	if results := processFeedsAsync(feeds, client); len(results) != 0 {
+		t.Errorf("got %d results for a skipped feed, want 0", len(results))
+	}
+	if *requests != 1 {
+		t.Fatalf("got %d requests within min_interval, want 1", *requests)
+	}
+
+	fake.Advance(time.Hour)
+	processFeedsAsync(feeds, client)
+	if *requests != 2 {
+		t.Fatalf("got %d requests after min_interval elapsed, want 2", *requests)
+	}
+}
+
+func TestBootstrapSinceNotifiesRecentItems(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+
+	ntfy, messages := ntfyServer(t)
+	feedSrv, _ := rssServer(t, rssItem("old", now.Add(-2*time.Hour))+rssItem("recent", now.Add(-30*time.Minute)))
+
+	configFile := writeConfig(t, fmt.Sprintf("feeds:\n  - url: %s\n    ntfy_topic: %s/test\n    bootstrap_since: 1h\n", feedSrv.URL, ntfy.URL))
+
+	cfg, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	result := processFeed(&cfg.Feeds[0], feedSrv.Client())
+	if result.Err != nil {
+		t.Fatalf("processFeed: %v", result.Err)
+	}
+	if result.Parsed != 2 || result.New != 1 || result.Notified != 1 {
+		t.Errorf("result = %+v, want 2 parsed, 1 new and 1 notified", result)
+	}
+
+	got := messages()
+	want := "recent\n\nhttps://example.com/recent"
+	if len(got) != 1 || got[0] != want {
+		t.Fatalf("got notifications %q, want [%q]", got, want)
+	}
+}
+
+func TestChannelSiteLinkIgnoresAtomSelfLink(t *testing.T) {
+	doc := `<rss xmlns:atom="http://www.w3.org/2005/Atom"><channel>
+<title>Site</title>
+<link>https://site.example/</link>
+<atom:link href="https://feeds.example/feed" rel="self" type="application/rss+xml"/>
+</channel></rss>`
+
+	_, rss, _, err := parseFeedBody([]byte(doc))
+	if err != nil {
+		t.Fatalf("parseFeedBody: %v", err)
+	}
+	if got := rss.Channel.siteLink(); got != "https://site.example/" {
+		t.Errorf("siteLink() = %q, want %q", got, "https://site.example/")
+	}
+	if got := feedIcon("https://feeds.example/feed", rss.Channel.siteLink(), ""); got != "https://site.example/favicon.ico" {
+		t.Errorf("feedIcon() = %q, want the site's favicon", got)
+	}
+}
+
+func TestBatchFeedsSerializesHostGroups(t *testing.T) {
+	feeds := []Feed{
+		{URL: "https://a.example/1", HostGroup: "auto"},
+		{URL: "https://b.example/feed", HostGroup: "shared", DedupGroup: "mirror"},
+		{URL: "https://A.example/2", HostGroup: "auto"},
+		{URL: "https://c.example/feed"},
+		{URL: "https://d.example/feed", HostGroup: "shared"},
+		{URL: "https://e.example/feed", DedupGroup: "mirror"},
+	}
+	var due []*Feed
+	for i := range feeds {
+		due = append(due, &feeds[i])
+	}
+
+	var got []string
+	for _, batch := range batchFeeds(due) {
+		var urls []string
+		for _, feed := range batch {
+			urls = append(urls, feed.URL)
+		}
+		got = append(got, strings.Join(urls, " "))
+	}
+	want := []string{
+		"https://a.example/1 https://A.example/2",
+		"https://b.example/feed https://d.example/feed https://e.example/feed",
+		"https://c.example/feed",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("batches:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDedupGroupTreatsEmptyModeAsTimestamp(t *testing.T) {
+	configFile := writeConfig(t, `feeds:
+  - url: https://a.example/feed
+    ntfy_topic: https://ntfy.example/a
+    dedup_group: news
+  - url: https://b.example/feed
+    ntfy_topic: https://ntfy.example/b
+    dedup_group: news
+    dedup_mode: timestamp
+`)
+	if _, err := loadConfig(configFile); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	configFile = writeConfig(t, `feeds:
+  - url: https://a.example/feed
+    ntfy_topic: https://ntfy.example/a
+    dedup_group: news
+  - url: https://b.example/feed
+    ntfy_topic: https://ntfy.example/b
+    dedup_group: news
+    dedup_mode: bloom
+`)
+	if _, err := loadConfig(configFile); err == nil {
+		t.Fatal("loadConfig accepted a dedup_group mixing timestamp and bloom")
+	}
+}
+
+func TestDefaultsTypoRejectedWithoutFeeds(t *testing.T) {
+	configFile := writeConfig(t, `defaults:
+  ntfy_topic: https://ntfy.example/all
+  priorty: 3
+feeds: []
+`)
+	_, err := loadConfig(configFile)
+	if err == nil {
+		t.Fatal("loadConfig accepted an unknown key in defaults")
+	}
+	if !strings.Contains(err.Error(), "line 3") || !strings.Contains(err.Error(), "priorty") {
+		t.Errorf("error %q does not point at the mistyped key", err)
+	}
+}
+
+func TestHungNtfyServerCountsAsFailure(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	saved := notifyClient
+	notifyClient = &http.Client{Timeout: 50 * time.Millisecond}
+	t.Cleanup(func() { notifyClient = saved })
+
+	logger := log.NewEntry(log.StandardLogger())
+	err := sendNotification(context.Background(), Notification{Topic: srv.URL + "/hung", Title: "t", Link: "l"}, logger)
+	if err == nil {
+		t.Fatal("sendNotification to a hung server returned no error")
+	}
+	if cb, _ := breakerFor(srv.URL + "/hung"); cb.failures != 1 {
+		t.Errorf("breaker recorded %d failures, want 1", cb.failures)
+	}
+}
+
+func TestNormalizeTopic(t *testing.T) {
+	tests := []struct {
+		topic, want string
+		wantErr     bool
+	}{
+		{topic: "https://ntfy.sh/alerts", want: "https://ntfy.sh/alerts"},
+		{topic: "  https://ntfy.sh/alerts\n", want: "https://ntfy.sh/alerts"},
+		{topic: "https://ntfy.sh/my alerts", want: "https://ntfy.sh/my%20alerts"},
+		{topic: "ntfy.sh/alerts", wantErr: true},
+		{topic: "ftp://ntfy.sh/alerts", wantErr: true},
+		{topic: "https:///alerts", wantErr: true},
+		{topic: "https://ntfy.sh/", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := normalizeTopic(tt.topic)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("normalizeTopic(%q) = %q, want an error", tt.topic, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeTopic(%q) = %q, %v, want %q", tt.topic, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoadAuthFile(t *testing.T) {
+	tests := []struct {
+		name, file string
+		want       map[string]string
+		wantErr    bool
+	}{
+		{
+			name: "topics and servers",
+			file: "https://ntfy.sh/alerts: tk_topic\nhttps://ntfy.example.com/: \" user:pass \"\n",
+			want: map[string]string{"https://ntfy.sh/alerts": "tk_topic", "https://ntfy.example.com": "user:pass"},
+		},
+		{name: "empty token", file: "https://ntfy.sh/alerts: \"\"\n", wantErr: true},
+		{name: "not a mapping", file: "- https://ntfy.sh/alerts\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := loadAuthFile(writeConfig(t, tt.file))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: loadAuthFile = %v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: loadAuthFile = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+	if _, err := loadAuthFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("loadAuthFile accepted a missing file")
+	}
+}
+
+func TestTokenFor(t *testing.T) {
+	topicTokens = map[string]string{
+		"https://ntfy.sh/alerts": "tk_topic",
+		"https://ntfy.sh":        "tk_server",
+	}
+	t.Cleanup(func() { topicTokens = map[string]string{} })
+	tests := []struct {
+		name, topic, feedToken, want string
+	}{
+		{"feed token wins over the auth file", "https://ntfy.sh/alerts", "tk_feed", "tk_feed"},
+		{"topic entry wins over its server", "https://ntfy.sh/alerts", "", "tk_topic"},
+		{"topic entry ignores a trailing slash", "https://ntfy.sh/alerts/", "", "tk_topic"},
+		{"server entry for other topics", "https://ntfy.sh/news", "", "tk_server"},
+		{"no entry", "https://ntfy.example.com/news", "", ""},
+	}
+	for _, tt := range tests {
+		if got := tokenFor(tt.topic, tt.feedToken); got != tt.want {
+			t.Errorf("%s: tokenFor(%q, %q) = %q, want %q", tt.name, tt.topic, tt.feedToken, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorizationHeader(t *testing.T) {
+	tests := []struct {
+		token, want string
+	}{
+		{"tk_abc", "Bearer tk_abc"},
+		{"user:pass", "Basic dXNlcjpwYXNz"},
+		{"Bearer tk_abc", "Bearer tk_abc"},
+		{"Basic dXNlcjpwYXNz", "Basic dXNlcjpwYXNz"},
+	}
+	for _, tt := range tests {
+		if got := authorizationHeader(tt.token); got != tt.want {
+			t.Errorf("authorizationHeader(%q) = %q, want %q", tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestDeadLetterRedelivery(t *testing.T) {
+	var mu sync.Mutex
+	fail := true
+	var delivered []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered = append(delivered, r.Header.Get("Authorization"))
+	}))
+	t.Cleanup(srv.Close)
+
+	deadLetters = &deadLetterQueue{}
+	t.Cleanup(func() { deadLetters = nil })
+
+	feeds := []Feed{{URL: "https://a.example/feed", NtfyTopic: srv.URL + "/dlq", NtfyToken: "tk_secret"}}
+	n := Notification{Topic: srv.URL + "/dlq", Token: "tk_secret", Feed: feeds[0].URL, Title: "t", Link: "l"}
+	logger := log.NewEntry(log.StandardLogger())
+	if err := notify(context.Background(), n, logger); err == nil {
+		t.Fatal("notify to a failing server returned no error")
+	}
+
+	stateFile := filepath.Join(t.TempDir(), "dead-letters.json")
+	if err := deadLetters.save(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(stateFile); bytes.Contains(data, []byte("tk_secret")) {
+		t.Errorf("dead-letter file holds the token: %s", data)
+	}
+	loaded, err := loadDeadLetters(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.items) != 1 {
+		t.Fatalf("loaded %d dead letters, want 1", len(loaded.items))
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	loaded.redeliver(feeds)
+	if want := []string{"Bearer tk_secret"}; !reflect.DeepEqual(delivered, want) || len(loaded.items) != 0 {
+		t.Errorf("after redelivery: delivered with %q, %d queued, want %q and 0", delivered, len(loaded.items), want)
+	}
+}
+
+func TestRejectedNotificationIsNotDeadLettered(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	t.Cleanup(srv.Close)
+
+	deadLetters = &deadLetterQueue{}
+	t.Cleanup(func() { deadLetters = nil })
+
+	err := notify(context.Background(), Notification{Topic: srv.URL + "/dlq", Title: "t", Link: "l"}, log.NewEntry(log.StandardLogger()))
+	if !errors.Is(err, errRejected) {
+		t.Fatalf("notify error = %v, want a rejection", err)
+	}
+	if len(deadLetters.items) != 0 {
+		t.Errorf("rejected notification was queued: %+v", deadLetters.items)
+	}
+
+	// One queued before the server started rejecting it is dropped too.
+	deadLetters.add(deadLetter{Notification: Notification{Topic: srv.URL + "/dlq", Title: "t"}, Attempts: 1})
+	deadLetters.redeliver(nil)
+	if len(deadLetters.items) != 0 || requests != 2 {
+		t.Errorf("after redelivery: %d queued and %d requests, want 0 and 2", len(deadLetters.items), requests)
+	}
+}
+
+func TestNotifyRetry(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := useFakeClock(t, start)
+
+	var mu sync.Mutex
+	requests := 0
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests < 3 {
+			w.WriteHeader(status)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	saved := notifyRetry
+	notifyRetry = NotifyRetryConfig{Attempts: 3, Backoff: time.Second, Redeliveries: 10}
+	t.Cleanup(func() { notifyRetry = saved })
+
+	logger := log.NewEntry(log.StandardLogger())
+	if err := notify(context.Background(), Notification{Topic: srv.URL + "/retry", Title: "t"}, logger); err != nil {
+		t.Fatalf("notify: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("server got %d requests, want 3", requests)
+	}
+	if waited := fake.Now().Sub(start); waited != 3*time.Second {
+		t.Errorf("backoff waited %v, want 3s", waited)
+	}
+
+	// A rejected notification is not tried again.
+	requests = 0
+	status = http.StatusBadRequest
+	err := notify(context.Background(), Notification{Topic: srv.URL + "/retry", Title: "t"}, logger)
+	if !errors.Is(err, errRejected) {
+		t.Fatalf("notify error = %v, want errRejected", err)
+	}
+	if requests != 1 {
+		t.Errorf("server got %d requests for a rejected notification, want 1", requests)
+	}
+}
+
+func TestMaxItemAgeSkipsOldItems(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+
+	ntfy, messages := ntfyServer(t)
+	feed := &Feed{
+		NtfyTopic:  ntfy.URL + "/test",
+		MaxItemAge: 24 * time.Hour,
+		LastUpdate: now.Add(-72 * time.Hour),
+	}
+	rss := Rss{Channel: Channel{Item: []Item{
+		{Title: "backfilled", Link: "https://example.com/backfilled", Published: now.Add(-48 * time.Hour).Format(time.RFC1123Z)},
+		{Title: "fresh", Link: "https://example.com/fresh", Published: now.Add(-time.Hour).Format(time.RFC1123Z)},
+	}}}
+
+	if err := processRSSFeed(context.Background(), feed, rss, &FeedResult{}, log.NewEntry(log.StandardLogger())); err != nil {
+		t.Fatalf("processRSSFeed: %v", err)
+	}
+	got := messages()
+	if len(got) != 1 || got[0] != "fresh\n\nhttps://example.com/fresh" {
+		t.Fatalf("got notifications %q, want only the fresh item", got)
+	}
+	if !feed.LastUpdate.Equal(now.Add(-time.Hour)) {
+		t.Errorf("LastUpdate = %v, want the newest item's date", feed.LastUpdate)
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "feeds: []\n"))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.tlsMinVersion != tls.VersionTLS12 {
+		t.Errorf("default tls min version = %x, want TLS 1.2", cfg.tlsMinVersion)
+	}
+
+	if _, err := loadConfig(writeConfig(t, "tls_min_version: \"1.4\"\nfeeds: []\n")); err == nil {
+		t.Error("loadConfig accepted tls_min_version 1.4")
+	}
+}
+
+func TestIPPreference(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	t.Cleanup(func() { ipPreference = "" })
+
+	// An IPv4-only address is still reached when preferring IPv6.
+	for _, preference := range []string{"ipv4", "ipv6"} {
+		ipPreference = preference
+		conn, err := dialContext(context.Background(), "tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("%s: dialContext: %v", preference, err)
+		}
+		conn.Close()
+	}
+
+	if _, err := loadConfig(writeConfig(t, "ip_preference: ipv5\nfeeds: []\n")); err == nil {
+		t.Error("loadConfig accepted ip_preference ipv5")
+	}
+}
+
+func TestOnionFeedsUseTorClient(t *testing.T) {
+	saved := torClient
+	torClient = &http.Client{}
+	t.Cleanup(func() { torClient = saved })
+
+	client := &http.Client{}
+	if got := clientFor(&Feed{URL: "http://abcdefghijklmnop.onion/feed"}, client); got != torClient {
+		t.Error("onion feed did not use the Tor client")
+	}
+	if got := clientFor(&Feed{URL: "https://example.com/feed", Tor: true}, client); got != torClient {
+		t.Error("feed with tor set did not use the Tor client")
+	}
+	if got := clientFor(&Feed{URL: "https://example.com/feed"}, client); got != client {
+		t.Error("clearnet feed used the Tor client")
+	}
+
+	if _, err := loadConfig(writeConfig(t, "feeds:\n  - url: http://abcdefghijklmnop.onion/feed\n    ntfy_topic: https://ntfy.example/t\n")); err == nil {
+		t.Error("loadConfig accepted an onion feed without tor.proxy")
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	want := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := map[string]time.Time{
+		"Tue, 02 Jan 2024 15:04:05 +0000": want,
+		"Tue, 2 Jan 2024 15:04:05 +0000":  want,
+		"2024-01-02T15:04:05Z":            want,
+		"2024-01-02T15:04:05.123456789Z":  want.Add(123456789),
+		"  2024-01-02T15:04:05+00:00\n":   want,
+		"2024-01-02 15:04:05":             want,
+		"2024-01-02":                      time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		"Tuesday, 02-Jan-24 15:04:05 UTC": want,
+		"Tue, 2 Jan 2024 15:04 +0000":     want.Add(-5 * time.Second),
+	}
+	for input, want := range tests {
+		got, err := parseDate(input)
+		if err != nil {
+			t.Errorf("parseDate(%q): %v", input, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("parseDate(%q) = %v, want %v", input, got, want)
+		}
+	}
+}
+
+func TestExecHookGatesNotification(t *testing.T) {
+	logger := log.NewEntry(log.StandardLogger())
+	data := templateData{Title: "title", Link: "https://example.com/item", Feed: "https://example.com/feed"}
+
+	tests := []struct {
+		name string
+		hook ExecHook
+		want bool
+	}{
+		{"success", ExecHook{Command: []string{"sh", "-c", `test "$RSS_LINK" = "{{.Link}}"`}, Gate: true}, true},
+		{"gated failure", ExecHook{Command: []string{"false"}, Gate: true}, false},
+		{"ungated failure", ExecHook{Command: []string{"false"}}, true},
+		{"instead", ExecHook{Command: []string{"true"}, Instead: true}, false},
+	}
+	for _, tt := range tests {
+		send, err := runExec(&tt.hook, data, logger)
+		if err != nil {
+			t.Errorf("%s: runExec: %v", tt.name, err)
+		}
+		if send != tt.want {
+			t.Errorf("%s: send = %v, want %v", tt.name, send, tt.want)
+		}
+	}
+
+	hook := ExecHook{Command: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond, Gate: true}
+	if send, err := runExec(&hook, data, logger); err == nil || send {
+		t.Errorf("timed out hook: send = %v, err = %v, want false and an error", send, err)
+	}
+}
+
+func TestFeedResultCategory(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html><body>not a feed</body></html>")
+	}))
+	t.Cleanup(srv.Close)
+
+	result := processFeed(&Feed{URL: srv.URL, NtfyTopic: "http://ntfy.invalid/test"}, srv.Client())
+	if result.Category() != "parse" {
+		t.Errorf("Category() = %q for %v, want parse", result.Category(), result.Err)
+	}
+
+	result = processFeed(&Feed{URL: "http://127.0.0.1:1/feed", NtfyTopic: "http://ntfy.invalid/test"}, srv.Client())
+	if result.Category() != "fetch" {
+		t.Errorf("Category() = %q for %v, want fetch", result.Category(), result.Err)
+	}
+}
+
+func TestContentTypeAllowlist(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		fmt.Fprint(w, "<rss><channel><title>Test</title></channel></rss>")
+	}))
+	t.Cleanup(srv.Close)
+	logger := log.NewEntry(log.StandardLogger())
+
+	for contentType, ok := range map[string]bool{
+		"application/rss+xml; charset=utf-8": true,
+		"text/xml":                           true,
+		"application/feed+json":              true,
+		"text/html; charset=utf-8":           false,
+		"image/png":                          false,
+	} {
+		feed := &Feed{URL: srv.URL + "/?type=" + url.QueryEscape(contentType)}
+		_, err := fetchFeedBody(context.Background(), feed, srv.Client(), logger)
+		if ok && err != nil {
+			t.Errorf("%s: fetchFeedBody: %v", contentType, err)
+		}
+		if !ok && !errors.Is(err, ErrParse) {
+			t.Errorf("%s: fetchFeedBody error = %v, want a parse error", contentType, err)
+		}
+	}
+
+	feed := &Feed{URL: srv.URL + "/?type=text/html", IgnoreContentType: true}
+	if _, err := fetchFeedBody(context.Background(), feed, srv.Client(), logger); err != nil {
+		t.Errorf("ignore_content_type: fetchFeedBody: %v", err)
+	}
+}
+
+func TestRetryNetworkFailures(t *testing.T) {
+	useFakeClock(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	// Reserve a port, then start serving on it only after the first check,
+	// as if the network came up late.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	feeds := []Feed{{URL: "http://" + addr + "/feed", NtfyTopic: "http://ntfy.invalid/test"}}
+	results := processFeedsAsync(feeds, http.DefaultClient)
+	if len(results) != 1 || !isNetworkError(results[0].Err) {
+		t.Fatalf("first check results = %+v, want a network error", results)
+	}
+
+	listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("could not listen on %s again: %v", addr, err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<rss><channel><title>Test</title></channel></rss>")
+	}))
+	srv.Listener = listener
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	retryNetworkFailures(feeds, results, http.DefaultClient)
+	if feeds[0].lastSuccess.IsZero() {
+		t.Error("feed was not retried successfully once the server came up")
+	}
+}
+
+func TestHashDedupModeNotifiesDatelessItems(t *testing.T) {
+	ntfy, messages := ntfyServer(t)
+	feed := &Feed{NtfyTopic: ntfy.URL + "/test", DedupMode: "hash"}
+	logger := log.NewEntry(log.StandardLogger())
+	poll := func(titles ...string) {
+		t.Helper()
+		var items []Item
+		for _, title := range titles {
+			items = append(items, Item{Title: title, Link: "https://example.com/" + title})
+		}
+		if err := processRSSFeed(context.Background(), feed, Rss{Channel: Channel{Item: items}}, &FeedResult{}, logger); err != nil {
+			t.Fatalf("processRSSFeed: %v", err)
+		}
+		feed.primed = true
+	}
+
+	poll("a", "b")
+	if got := messages(); len(got) != 0 {
+		t.Fatalf("first poll notified %q, want nothing", got)
+	}
+	poll("c", "a", "b")
+	if got := messages(); len(got) != 1 || got[0] != "c\n\nhttps://example.com/c" {
+		t.Fatalf("second poll notified %q, want only c", got)
+	}
+
+	restored := []Feed{{URL: feed.URL, DedupMode: "hash"}}
+	applyState(restored, &State{Feeds: map[string]*FeedState{feed.URL: {Hashes: feed.hashes.list()}}})
+	if !restored[0].primed || !restored[0].hashes.Test(contentHash("c", "https://example.com/c")) {
+		t.Error("hash set was not restored from the state file")
+	}
+}
+
+func TestBloomDedupMode(t *testing.T) {
+	filter := newBloomFilter(1000, 0.01)
+	for i := range 1000 {
+		filter.Add(fmt.Sprintf("seen-%d", i))
+	}
+	for i := range 1000 {
+		if !filter.Test(fmt.Sprintf("seen-%d", i)) {
+			t.Fatalf("added key seen-%d tests as absent", i)
+		}
+	}
+	falsePositives := 0
+	for i := range 10000 {
+		if filter.Test(fmt.Sprintf("new-%d", i)) {
+			falsePositives++
+		}
+	}
+	// With a 1% target rate, 2% of 10000 keys is far beyond chance.
+	if falsePositives > 200 {
+		t.Errorf("%d of 10000 new keys test as seen, want about 1%%", falsePositives)
+	}
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	feed := &Feed{URL: "https://blog.example/feed", DedupMode: "bloom", BloomCapacity: 100}
+	if isNew(feed, "a", start) {
+		t.Error("first poll notified an item, want it only recorded")
+	}
+	feed.primed = true
+	if !isNew(feed, "b", start) {
+		t.Error("item added after the first poll not new")
+	}
+	// Bloom mode ignores dates, so an older item is new as well.
+	if !isNew(feed, "c", start.Add(-time.Hour)) {
+		t.Error("older unseen item not new")
+	}
+	if isNew(feed, "a", start) || isNew(feed, "b", start) {
+		t.Error("seen item new again")
+	}
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	if err := saveState(stateFile, []Feed{*feed}, nil); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := []Feed{
+		{URL: feed.URL, DedupMode: "bloom", BloomCapacity: 100},
+		{URL: feed.URL, DedupMode: "bloom", BloomCapacity: 5000},
+	}
+	applyState(restored, state)
+	if !restored[0].primed || restored[0].seen == nil {
+		t.Fatal("bloom filter was not restored from the state file")
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if isNew(&restored[0], key, start) {
+			t.Errorf("restored filter lost %q", key)
+		}
+	}
+	if !isNew(&restored[0], "d", start) {
+		t.Error("restored filter treats an unseen item as seen")
+	}
+	if restored[1].seen != nil || restored[1].primed {
+		t.Error("filter saved with another bloom_capacity was restored")
+	}
+}
+
+func TestNotifyOnRemoval(t *testing.T) {
+	ntfy, messages := ntfyServer(t)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	feed := &Feed{NtfyTopic: ntfy.URL + "/test", NotifyOnRemoval: true, LastUpdate: start}
+	logger := log.NewEntry(log.StandardLogger())
+	poll := func(titles ...string) {
+		t.Helper()
+		var items []Item
+		for _, title := range titles {
+			items = append(items, Item{Title: title, Link: "https://example.com/" + title, Published: start.Add(-time.Hour).Format(time.RFC1123Z)})
+		}
+		if err := processRSSFeed(context.Background(), feed, Rss{Channel: Channel{Item: items}}, &FeedResult{}, logger); err != nil {
+			t.Fatalf("processRSSFeed: %v", err)
+		}
+	}
+
+	poll("a", "b", "c")
+	poll("a", "c")
+	poll("a", "c")
+	if got := messages(); len(got) != 1 || got[0] != "Removed: b\n\nhttps://example.com/b" {
+		t.Errorf("got notifications %q, want one for the removed item", got)
+	}
+}
+
+func TestDiffConfigFiles(t *testing.T) {
+	oldFile := writeConfig(t, `interval: 10m
+defaults:
+  ntfy_topic: https://ntfy.example/all
+feeds:
+  - url: https://a.example/feed
+  - url: https://b.example/feed
+    priority: 3
+`)
+	newFile := writeConfig(t, `interval: 30m
+defaults:
+  ntfy_topic: https://ntfy.example/all
+  priority: 3
+feeds:
+  - url: https://b.example/feed
+  - url: https://c.example/feed
+    priority: 5
+`)
+
+	var out strings.Builder
+	if err := diffConfigFiles(&out, oldFile, newFile); err != nil {
+		t.Fatalf("diffConfigFiles: %v", err)
+	}
+	want := `Settings:
+  ~ interval: 10m0s -> 30m0s
+Feeds:
+  + https://c.example/feed
+  - https://a.example/feed
+`
+	if out.String() != want {
+		t.Errorf("diff output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestGroupKeySetsTag(t *testing.T) {
+	tags := make(chan string, 1)
+	ntfy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tags <- r.Header.Get("X-Tags")
+	}))
+	t.Cleanup(ntfy.Close)
+
+	doc := `<feed xmlns="http://www.w3.org/2005/Atom"><entry>
+<title>Update 2</title><id>urn:2</id><published>2024-01-02T15:04:05Z</published>
+<category term="story-42"/>
+</entry></feed>`
+	_, _, atom, err := parseFeedBody([]byte(doc))
+	if err != nil || atom == nil {
+		t.Fatalf("parseFeedBody: %v", err)
+	}
+
+	feed := &Feed{NtfyTopic: ntfy.URL + "/test", GroupKey: "{{.Category}}"}
+	if err := processAtomFeed(context.Background(), feed, *atom, &FeedResult{}, log.NewEntry(log.StandardLogger())); err != nil {
+		t.Fatalf("processAtomFeed: %v", err)
+	}
+	if got := <-tags; got != "story-42" {
+		t.Errorf("X-Tags = %q, want %q", got, "story-42")
+	}
+}
+
+func TestTemplateTags(t *testing.T) {
+	recorder := &recordingNotifier{}
+	notifier = recorder
+	t.Cleanup(func() { notifier = NtfyNotifier{} })
+
+	doc := `<rss xmlns:dc="http://purl.org/dc/elements/1.1/"><channel><title>T</title>
+<item><title>one</title><guid>1</guid><pubDate>Tue, 02 Jan 2024 15:04:05 +0000</pubDate>
+<category>Release Notes, v2</category><dc:creator>Jane Doe</dc:creator></item>
+<item><title>two</title><guid>2</guid><pubDate>Tue, 02 Jan 2024 16:04:05 +0000</pubDate></item>
+</channel></rss>`
+	_, rss, _, err := parseFeedBody([]byte(doc))
+	if err != nil || rss == nil {
+		t.Fatalf("parseFeedBody: %v", err)
+	}
+
+	feed := &Feed{NtfyTopic: "https://ntfy.example/test", Tags: []string{"newspaper", "{{.Category}}", "{{.Author}}", "Newspaper"}}
+	if err := processRSSFeed(context.Background(), feed, *rss, &FeedResult{}, log.NewEntry(log.StandardLogger())); err != nil {
+		t.Fatalf("processRSSFeed: %v", err)
+	}
+	got := map[string]string{}
+	for _, n := range recorder.sent {
+		got[n.Title] = n.Tags
+	}
+	want := map[string]string{"one": "newspaper,release-notes-v2,jane-doe", "two": "newspaper"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tags = %v, want %v", got, want)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	recorder := &recordingNotifier{}
+	notifier = recorder
+	t.Cleanup(func() { notifier = NtfyNotifier{} })
+
+	config, err := loadConfig(writeConfig(t, `feeds:
+  - url: https://a.example/feed
+    ntfy_topic: https://ntfy.example/a
+    filter:
+      all:
+        - title: release
+        - category: go
+        - any:
+            - author: jane
+            - regex: "(?i)security fix"
+`))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	feed := &config.Feeds[0]
+	feed.LastUpdate = time.Time{}
+
+	doc := `<rss xmlns:dc="http://purl.org/dc/elements/1.1/"><channel><title>T</title>
+<item><title>Go release by Jane</title><guid>1</guid><pubDate>Tue, 02 Jan 2024 11:00:00 +0000</pubDate><category>Go</category><dc:creator>Jane Doe</dc:creator></item>
+<item><title>Go release with a security fix</title><guid>2</guid><pubDate>Tue, 02 Jan 2024 12:00:00 +0000</pubDate><category>Go</category></item>
+<item><title>Go release by Bob</title><guid>3</guid><pubDate>Tue, 02 Jan 2024 13:00:00 +0000</pubDate><category>Go</category><dc:creator>Bob</dc:creator></item>
+<item><title>Rust release by Jane</title><guid>4</guid><pubDate>Tue, 02 Jan 2024 14:00:00 +0000</pubDate><category>Rust</category><dc:creator>Jane</dc:creator></item>
+<item><title>Go news by Jane</title><guid>5</guid><pubDate>Tue, 02 Jan 2024 15:00:00 +0000</pubDate><category>Go</category><dc:creator>Jane</dc:creator></item>
+</channel></rss>`
+	_, rss, _, err := parseFeedBody([]byte(doc))
+	if err != nil || rss == nil {
+		t.Fatalf("parseFeedBody: %v", err)
+	}
+	if err := processRSSFeed(context.Background(), feed, *rss, &FeedResult{}, log.NewEntry(log.StandardLogger())); err != nil {
+		t.Fatalf("processRSSFeed: %v", err)
+	}
+	var titles []string
+	for _, n := range recorder.sent {
+		titles = append(titles, n.Title)
+	}
+	sort.Strings(titles)
+	if want := []string{"Go release by Jane", "Go release with a security fix"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("notified %q, want %q", titles, want)
+	}
+
+	for _, filter := range []string{"{}", "{regex: \"(\"}", "{any: [{}]}"} {
+		config := "feeds:\n  - url: https://a.example/feed\n    ntfy_topic: https://ntfy.example/a\n    filter: " + filter + "\n"
+		if _, err := loadConfig(writeConfig(t, config)); err == nil {
+			t.Errorf("loadConfig accepted filter %s", filter)
+		}
+	}
+}
+
+func TestDumpParseFailure(t *testing.T) {
+	useFakeClock(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	dir := t.TempDir()
+	parseDumpDir = dir
+	savedSize := parseDumpSize
+	parseDumpSize = 10
+	t.Cleanup(func() { parseDumpDir, parseDumpSize = "", savedSize })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, "<oops>this is not a feed</oops>")
+	}))
+	t.Cleanup(srv.Close)
+
+	feed := &Feed{URL: "http://user:hunter2@" + srv.Listener.Addr().String() + "/feed?token=hunter2&page=1"}
+	if result := processFeed(feed, srv.Client()); !errors.Is(result.Err, ErrParse) {
+		t.Fatalf("processFeed error = %v, want a parse error", result.Err)
+	}
+
+	dumps, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil || len(dumps) != 1 {
+		t.Fatalf("found dumps %v (%v), want one", dumps, err)
+	}
+	data, err := os.ReadFile(dumps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := string(data)
+	if strings.Contains(dump, "hunter2") {
+		t.Errorf("dump contains a credential:\n%s", dump)
+	}
+	if !strings.HasSuffix(dump, "\n\n<oops>this") {
+		t.Errorf("dump body is not truncated to 10 bytes:\n%s", dump)
+	}
+}
+
+func TestGroupIntervals(t *testing.T) {
+	fake := useFakeClock(t, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	news, newsRequests := rssServer(t, "")
+	blogs, blogRequests := rssServer(t, "")
+
+	feeds := []Feed{
+		{URL: news.URL, NtfyTopic: "http://ntfy.invalid/test", Group: "news"},
+		{URL: blogs.URL, NtfyTopic: "http://ntfy.invalid/test"},
+	}
+	tick := scheduleFeeds(feeds, map[string]time.Duration{"news": 5 * time.Minute}, time.Hour)
+	if tick != 5*time.Minute {
+		t.Fatalf("tick = %v, want the news group's 5m", tick)
+	}
+
+	for i := 0; i < 12; i++ {
+		processFeedsAsync(feeds, http.DefaultClient)
+		fake.Advance(tick)
+	}
+	if *newsRequests != 12 || *blogRequests != 1 {
+		t.Fatalf("after an hour of checks: %d news and %d blog requests, want 12 and 1", *newsRequests, *blogRequests)
+	}
+	processFeedsAsync(feeds, http.DefaultClient)
+	if *blogRequests != 2 {
+		t.Errorf("blog feed was not checked once the interval elapsed")
+	}
+
+	if _, err := loadConfig(writeConfig(t, "feeds:\n  - url: https://a.example/feed\n    ntfy_topic: https://ntfy.example/t\n    group: missing\n")); err == nil {
+		t.Error("loadConfig accepted a feed in an undefined group")
+	}
+}
+
+// useNotifyWorkers replaces the outbox with one sent from by the given
+// number of workers for the rest of the test.
+func useNotifyWorkers(t *testing.T, workers int) {
+	saved := outbox
+	outbox = newNotifyOutbox()
+	startNotifyWorkers(workers)
+	t.Cleanup(func() { outbox = saved })
+}
+
+func TestNotifyWorkersSendFromOutbox(t *testing.T) {
+	useNotifyWorkers(t, 1)
+
+	var mu sync.Mutex
+	var got []string
+	fail := map[string]bool{"c": true}
+	ntfy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		title := strings.SplitN(string(body), "\n", 2)[0]
+		mu.Lock()
+		defer mu.Unlock()
+		if fail[title] {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		got = append(got, title)
+	}))
+	t.Cleanup(ntfy.Close)
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	feeds := []Feed{{URL: "https://blog.example/feed", NtfyTopic: ntfy.URL + "/test", LastUpdate: start}}
+	feed := &feeds[0]
+	var items []Item
+	for i, title := range []string{"a", "b", "c", "d"} {
+		items = append(items, Item{Title: title, Link: "https://example.com/" + title, Published: start.Add(time.Duration(i+1) * time.Minute).Format(time.RFC1123Z)})
+	}
+
+	var result FeedResult
+	if err := processRSSFeed(context.Background(), feed, Rss{Channel: Channel{Item: items}}, &result, log.NewEntry(log.StandardLogger())); err != nil {
+		t.Fatalf("processRSSFeed: %v", err)
+	}
+	if want := start.Add(4 * time.Minute); !feed.LastUpdate.Equal(want) {
+		t.Errorf("LastUpdate = %v, want %v once the notifications are in the outbox", feed.LastUpdate, want)
+	}
+	outbox.drain()
+	if want := []string{"a", "b", "d"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+	if feed.notified != 3 {
+		t.Errorf("notified = %d, want 3", feed.notified)
+	}
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	if err := saveState(stateFile, feeds, outbox.pending()); err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Pending) != 1 || state.Pending[0].Title != "c" {
+		t.Fatalf("saved outbox = %+v, want the failed notification", state.Pending)
+	}
+
+	// After a restart, the saved notification is sent on the next check.
+	outbox = newNotifyOutbox()
+	startNotifyWorkers(1)
+	outbox.restore(state.Pending)
+	mu.Lock()
+	fail["c"] = false
+	mu.Unlock()
+	outbox.retry(feeds)
+	outbox.drain()
+	if want := []string{"a", "b", "d", "c"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+	if pending := outbox.pending(); len(pending) != 0 {
+		t.Errorf("outbox still holds %+v", pending)
+	}
+}
+
+func TestParseHFeed(t *testing.T) {
+	doc := `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Blog</title>
+<script>if (a < b) { x = "<div>"; }</script>
+</head><body>
+<div class="h-feed"><ul>
+<li><article class="h-entry">
+<h2 class="p-name">First&nbsp;post</h2><br>
+<a class="u-url" href="/posts/1">link</a>
+<time class="dt-published" datetime="2024-01-02T15:04:05Z">Jan 2</time>
+<p>Text <img src="x.png">
+<div class="h-entry"><span class="p-name">A quoted post</span></div>
+</article>
+<li><div class="h-entry"><a class="u-url p-name" href="https://other.example/2">Second <b>post</b></a>
+<span class="dt-published">2024-01-03</span></div>
+</ul></div>
+</body></html>`
+
+	rss, err := parseHFeed([]byte(doc), "https://blog.example/")
+	if err != nil {
+		t.Fatalf("parseHFeed: %v", err)
+	}
+	want := []Item{
+		{Title: "First post", Link: "https://blog.example/posts/1", Published: "2024-01-02T15:04:05Z"},
+		{Title: "Second post", Link: "https://other.example/2", Published: "2024-01-03"},
+	}
+	if len(rss.Channel.Item) != len(want) {
+		t.Fatalf("got %d items, want %d: %+v", len(rss.Channel.Item), len(want), rss.Channel.Item)
+	}
+	for i, item := range rss.Channel.Item {
+		if item.Title != want[i].Title || item.Link != want[i].Link || item.Published != want[i].Published {
+			t.Errorf("item %d = %q %q %q, want %q %q %q", i, item.Title, item.Link, item.Published, want[i].Title, want[i].Link, want[i].Published)
+		}
+	}
+}
+
+func TestNewestOnly(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ntfy, messages := ntfyServer(t)
+	feed := &Feed{NtfyTopic: ntfy.URL + "/test", NewestOnly: true, LastUpdate: start}
+	var items []Item
+	for i, title := range []string{"c", "a", "b"} {
+		items = append(items, Item{Title: title, Link: "https://example.com/" + title, Published: start.Add(time.Duration(3-i) * time.Minute).Format(time.RFC1123Z)})
+	}
+
+	var result FeedResult
+	if err := processRSSFeed(context.Background(), feed, Rss{Channel: Channel{Item: items}}, &result, log.NewEntry(log.StandardLogger())); err != nil {
+		t.Fatalf("processRSSFeed: %v", err)
+	}
+	if got := messages(); len(got) != 1 || got[0] != "c\n\nhttps://example.com/c" {
+		t.Fatalf("got notifications %q, want only the newest item", got)
+	}
+	if result.New != 3 || !feed.LastUpdate.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("New = %d, LastUpdate = %v, want all 3 items recorded", result.New, feed.LastUpdate)
+	}
+}
+
+func TestEnvDefaults(t *testing.T) {
+	t.Setenv("NTFY_DEFAULT_SERVER", "https://ntfy.example.com/")
+	t.Setenv("NTFY_DEFAULT_TOPIC", "everything")
+	t.Setenv("NTFY_DEFAULT_TOKEN", "tk_default")
+	t.Setenv("NTFY_DEFAULT_PRIORITY", "2")
+
+	cfg, err := loadConfig(writeConfig(t, `feeds:
+  - url: https://a.example/feed
+  - url: https://b.example/feed
+    ntfy_topic: alerts
+    priority: 4
+  - url: https://c.example/feed
+    ntfy_topic: https://ntfy.other.com/c
+`))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	want := []struct {
+		topic    string
+		priority int
+	}{
+		{"https://ntfy.example.com/everything", 2},
+		{"https://ntfy.example.com/alerts", 4},
+		{"https://ntfy.other.com/c", 2},
+	}
+	for i, w := range want {
+		if got := cfg.Feeds[i]; got.NtfyTopic != w.topic || got.Priority != w.priority {
+			t.Errorf("feed %d: topic %q priority %d, want %q and %d", i+1, got.NtfyTopic, got.Priority, w.topic, w.priority)
+		}
+	}
+
+	tokens := map[string]string{}
+	if err := addEnvToken(tokens); err != nil {
+		t.Fatalf("addEnvToken: %v", err)
+	}
+	if tokens["https://ntfy.example.com"] != "tk_default" {
+		t.Errorf("tokens = %v, want tk_default for the default server", tokens)
+	}
+}
+
+func TestNotifyTimeoutOverridesDefault(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	start := time.Now()
+	err := sendNotification(context.Background(), Notification{Topic: srv.URL + "/slow", Title: "t", Link: "l", Timeout: 50 * time.Millisecond}, log.NewEntry(log.StandardLogger()))
+	if err == nil {
+		t.Fatal("sendNotification to a hung server returned no error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("send took %v, want it cut off by the 50ms notify_timeout", elapsed)
+	}
+}
+
+func TestNotBeforeFloor(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `feeds:
+  - url: https://a.example/feed
+    ntfy_topic: https://ntfy.example/a
+    dedup_mode: hash
+    not_before: 2024-01-15
+`))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	feed := &cfg.Feeds[0]
+	floor := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	if !feed.NotBefore.Equal(floor) {
+		t.Fatalf("NotBefore = %v, want %v", feed.NotBefore, floor)
+	}
+	if !tooOld(feed, floor.Add(-time.Hour)) || tooOld(feed, floor.Add(time.Hour)) || tooOld(feed, time.Time{}) {
+		t.Error("tooOld does not treat not_before as a floor for dated items only")
+	}
+}
+
+func TestAPIKeyParam(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("apikey") != "s3cret" || r.URL.Query().Get("page") != "1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "<rss><channel><title>Test</title></channel></rss>")
+	}))
+	t.Cleanup(srv.Close)
+
+	feed := &Feed{URL: srv.URL + "/feed?page=1", APIKeyParam: "apikey", APIKey: "s3cret"}
+	body, err := fetchFeedBody(context.Background(), feed, srv.Client(), log.NewEntry(log.StandardLogger()))
+	if err != nil || !strings.Contains(string(body), "<rss>") {
+		t.Fatalf("fetchFeedBody = %q, %v, want the feed", body, err)
+	}
+
+	feed.URL = "http://127.0.0.1:1/feed"
+	_, err = fetchFeedBody(context.Background(), feed, srv.Client(), log.NewEntry(log.StandardLogger()))
+	if err == nil || strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("fetch error %v, want an error without the API key", err)
+	}
+}
+
+func TestLinklessItemNotification(t *testing.T) {
+	type request struct{ body, click, actions string }
+	requests := make(chan request, 2)
+	ntfy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{string(body), r.Header.Get("X-Click"), r.Header.Get("X-Actions")}
+	}))
+	t.Cleanup(ntfy.Close)
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	feed := &Feed{
+		NtfyTopic:  ntfy.URL + "/test",
+		LastUpdate: start,
+		Actions:    []Action{{Action: "view", Label: "Open"}},
+	}
+	rss := Rss{Channel: Channel{Item: []Item{
+		{Title: "no link", Published: start.Add(time.Minute).Format(time.RFC1123Z)},
+		{Title: "linked", Link: "https://example.com/linked", Published: start.Add(2 * time.Minute).Format(time.RFC1123Z)},
+	}}}
+	if err := processRSSFeed(context.Background(), feed, rss, &FeedResult{}, log.NewEntry(log.StandardLogger())); err != nil {
+		t.Fatalf("processRSSFeed: %v", err)
+	}
+
+	if got := <-requests; got != (request{body: "no link"}) {
+		t.Errorf("link-less item sent %+v, want only its title", got)
+	}
+	got := <-requests
+	if got.body != "linked\n\nhttps://example.com/linked" || got.click != "https://example.com/linked" || got.actions == "" {
+		t.Errorf("linked item sent %+v, want its link in the body, X-Click and the view action", got)
+	}
+}
+
+func TestPruneState(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	feeds := []Feed{{URL: "https://a.example/feed"}, {URL: "https://b.example/feed"}, {URL: "https://c.example/feed"}}
+	if err := saveState(stateFile, feeds, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := pruneState(stateFile, feeds[1:2])
+	if err != nil {
+		t.Fatalf("pruneState: %v", err)
+	}
+	if want := "https://a.example/feed https://c.example/feed"; strings.Join(removed, " ") != want {
+		t.Errorf("removed %q, want %q", removed, want)
+	}
+
+	state, err := loadState(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Feeds["https://b.example/feed"]; len(state.Feeds) != 1 || !ok {
+		t.Errorf("state after pruning has feeds %v, want only b", state.Feeds)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	configFile := writeConfig(t, `feeds:
+  - url: https://a.example/feed
+    ntfy_topic: https://ntfy.example/a
+`)
+	running, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastUpdate := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	running.Feeds[0].LastUpdate = lastUpdate
+	running.Feeds[0].notified = 3
+
+	if err := os.WriteFile(configFile, []byte(`feeds:
+  - url: https://a.example/feed
+    ntfy_topic: https://ntfy.example/renamed
+  - url: https://b.example/feed
+    ntfy_topic: https://ntfy.example/b
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := reloadConfig(configFile, running)
+	if err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+	if len(reloaded.Feeds) != 2 || reloaded.Feeds[0].NtfyTopic != "https://ntfy.example/renamed" {
+		t.Fatalf("reloaded feeds %+v", reloaded.Feeds)
+	}
+	if a := reloaded.Feeds[0]; !a.LastUpdate.Equal(lastUpdate) || a.notified != 3 {
+		t.Errorf("kept feed has last update %v and %d notified, want %v and 3", a.LastUpdate, a.notified, lastUpdate)
+	}
+	if b := reloaded.Feeds[1]; b.LastUpdate.Equal(lastUpdate) {
+		t.Errorf("new feed took the last update of another feed")
+	}
+
+	if err := os.WriteFile(configFile, []byte("feeds:\n  - url: https://a.example/feed\n    bogus: 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloadConfig(configFile, running); err == nil {
+		t.Error("reloadConfig accepted an invalid config")
+	}
+}
+
+func TestHTMLToMarkdown(t *testing.T) {
+	in := `<p>Hello <b>bold</b> and <em>some_thing</em>.</p>
+<script>alert("x")</script>
+<p><a href="https://example.com/a">a link</a>, <a href="javascript:alert(1)">no link</a><img src="x.png"></p>
+<ul><li>one</li><li>two <code>x*y</code></li></ul>
+<p onclick="evil()">1 &lt; 2<br>next</p>`
+	want := "Hello **bold** and _some\\_thing_.\n\n" +
+		"[a link](https://example.com/a), no link\n\n" +
+		"- one\n- two `x*y`\n\n" +
+		"1 < 2\nnext"
+	if got := htmlToMarkdown(in); got != want {
+		t.Errorf("htmlToMarkdown() =\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestItemContentFallsBackToDescription(t *testing.T) {
+	doc := `<rss xmlns:content="http://purl.org/rss/1.0/modules/content/"><channel><title>T</title>
+<item><title>full</title><description>Summary</description><content:encoded><![CDATA[<p>Full <b>text</b></p>]]></content:encoded></item>
+<item><title>summary</title><description>&lt;p&gt;Only a summary&lt;/p&gt;</description></item>
+</channel></rss>`
+	_, rss, _, err := parseFeedBody([]byte(doc))
+	if err != nil {
+		t.Fatalf("parseFeedBody: %v", err)
+	}
+	var got []string
+	for _, item := range rss.Channel.Item {
+		got = append(got, htmlToMarkdown(item.html()))
+	}
+	if want := []string{"Full **text**", "Only a summary"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	_, err := loadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("loadConfig error = %v, want a missing file error", err)
+	}
+}
+
+func TestLoadConfigFromURLFallsBackToCache(t *testing.T) {
+	body := "feeds:\n  - url: https://a.example/feed\n    ntfy_topic: https://ntfy.example/t\n"
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	useConfigServer(t, srv)
+
+	saved := configCacheFile
+	configCacheFile = filepath.Join(t.TempDir(), "config-cache.yaml")
+	t.Cleanup(func() { configCacheFile = saved })
+
+	if _, err := loadConfig(srv.URL + "/feeds.yaml"); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	srv.Close()
+
+	cfg, err := loadConfig(srv.URL + "/feeds.yaml")
+	if err != nil {
+		t.Fatalf("loadConfig with the server down: %v", err)
+	}
+	if len(cfg.Feeds) != 1 || cfg.Feeds[0].URL != "https://a.example/feed" {
+		t.Errorf("feeds from cache = %+v, want the cached feed", cfg.Feeds)
+	}
+}
+
+// useConfigServer makes configClient trust srv's certificate.
+func useConfigServer(t *testing.T, srv *httptest.Server) {
+	saved := configClient.Transport
+	configClient.Transport = srv.Client().Transport
+	t.Cleanup(func() { configClient.Transport = saved })
+}
+
+func TestRemoteConfigRequiresHTTPS(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "feeds:\n  - url: https://a.example/feed\n    ntfy_topic: https://ntfy.example/t\n")
+	}))
+	t.Cleanup(plain.Close)
+	if _, err := loadConfig(plain.URL + "/feeds.yaml"); err == nil || !strings.Contains(err.Error(), "must use https") {
+		t.Errorf("loadConfig over http: error = %v, want it refused", err)
+	}
+
+	redirect := httptest.NewTLSServer(http.RedirectHandler(plain.URL+"/feeds.yaml", http.StatusFound))
+	t.Cleanup(redirect.Close)
+	useConfigServer(t, redirect)
+	if _, err := loadConfig(redirect.URL + "/feeds.yaml"); err == nil || !strings.Contains(err.Error(), "isn't https") {
+		t.Errorf("loadConfig redirected to http: error = %v, want it refused", err)
+	}
+}
+
+func TestTemplateLocaltime(t *testing.T) {
+	data := templateData{Published: time.Date(2024, 7, 1, 16, 30, 0, 0, time.UTC)}
+	got, err := renderTemplate(`{{(.Published | localtime "America/New_York").Format "15:04 MST"}}`, data)
+	if err != nil {
+		t.Fatalf("renderTemplate: %v", err)
+	}
+	if got != "12:30 EDT" {
+		t.Errorf("rendered %q, want %q", got, "12:30 EDT")
+	}
+}
+
+func TestStartupGraceSuppressesNotifications(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fake := useFakeClock(t, now)
+	graceUntil = now.Add(time.Minute)
+	t.Cleanup(func() { graceUntil = time.Time{} })
+
+	ntfy, messages := ntfyServer(t)
+	feedSrv, _ := rssServer(t, rssItem("recent", now.Add(-30*time.Minute)))
+	feed := &Feed{URL: feedSrv.URL, NtfyTopic: ntfy.URL + "/test", LastUpdate: now.Add(-time.Hour)}
+
+	result := processFeed(feed, feedSrv.Client())
+	if result.Err != nil || result.New != 1 || result.Notified != 0 {
+		t.Fatalf("during grace: result = %+v, want 1 new and 0 notified", result)
+	}
+	fake.Advance(2 * time.Minute)
+	if result := processFeed(feed, feedSrv.Client()); result.New != 0 {
+		t.Errorf("after grace: %d new items, want the item to stay seen", result.New)
+	}
+	if got := messages(); len(got) != 0 {
+		t.Errorf("got notifications %q, want none", got)
+	}
+}
+
+func TestSendFailuresInStatusFile(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	t.Cleanup(srv.Close)
+	saved := sendFailures
+	sendFailures = &failureCounter{counts: map[sendFailureKey]int{}}
+	t.Cleanup(func() { sendFailures = saved })
+
+	err := sendNotification(context.Background(), Notification{Topic: srv.URL + "/t", Title: "t"}, log.NewEntry(log.StandardLogger()))
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.Status != http.StatusForbidden {
+		t.Fatalf("sendNotification error = %v, want a SendError with status 403", err)
+	}
+
+	statusFile := filepath.Join(t.TempDir(), "status")
+	if err := writeStatusFile(statusFile, time.Now(), nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(statusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("topic=%s/t status=403 send_failures=1\n", srv.URL); !strings.Contains(string(data), want) {
+		t.Errorf("status file:\n%s\nwant a line %q", data, want)
+	}
+}
+
+func TestReplayFeedsIgnoresState(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+
+	ntfy, messages := ntfyServer(t)
+	feedSrv, _ := rssServer(t, rssItem("old", now.Add(-48*time.Hour))+rssItem("missed", now.Add(-2*time.Hour)))
+	feeds := []Feed{{URL: feedSrv.URL, NtfyTopic: ntfy.URL + "/test", LastUpdate: now}}
+
+	replayFeeds(feeds, 24*time.Hour, 0, feedSrv.Client())
+	if got := messages(); len(got) != 1 || !strings.HasPrefix(got[0], "missed") {
+		t.Errorf("got notifications %q, want only the missed item", got)
+	}
+	if !feeds[0].LastUpdate.Equal(now) {
+		t.Errorf("LastUpdate changed to %v by replay", feeds[0].LastUpdate)
+	}
+}
+
+// recordingNotifier is a Notifier that keeps what it is sent.
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func (r *recordingNotifier) Send(ctx context.Context, n Notification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sent = append(r.sent, n)
+	return nil
+}
+
+func TestFeedsNotifyThroughNotifier(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+	recorder := &recordingNotifier{}
+	notifier = recorder
+	t.Cleanup(func() { notifier = NtfyNotifier{} })
+
+	feedSrv, _ := rssServer(t, rssItem("new", now.Add(-time.Minute)))
+	feed := &Feed{URL: feedSrv.URL, NtfyTopic: "https://ntfy.example/test", LastUpdate: now.Add(-time.Hour)}
+	if result := processFeed(feed, feedSrv.Client()); result.Err != nil || result.Notified != 1 {
+		t.Fatalf("result = %+v, want 1 notified", result)
+	}
+	if len(recorder.sent) != 1 || recorder.sent[0].Title != "new" {
+		t.Errorf("notifier got %+v, want the new item", recorder.sent)
+	}
+}
+
+func TestSingleLineMessage(t *testing.T) {
+	n := Notification{Title: "Title", Link: "https://example.com/a", SingleLine: true}
+	if got, want := n.message(), "Title — https://example.com/a"; got != want {
+		t.Errorf("message() = %q, want %q", got, want)
+	}
+	n.SingleLine = false
+	if got, want := n.message(), "Title\n\nhttps://example.com/a"; got != want {
+		t.Errorf("message() = %q, want %q", got, want)
+	}
+}
+
+func TestMessageMaxBody(t *testing.T) {
+	n := Notification{Title: "Ünïcödé title", Link: "https://example.com/a", MaxBody: 8}
+	if got, want := n.message(), "Ünïcödé…"; got != want {
+		t.Errorf("message() = %q, want %q", got, want)
+	}
+	n.MaxBody = 100
+	if got, want := n.message(), "Ünïcödé title\n\nhttps://example.com/a"; got != want {
+		t.Errorf("message() = %q, want %q", got, want)
+	}
+}
+
+func TestMessageLinkPositionAndSeparator(t *testing.T) {
+	n := Notification{Title: "Title", Link: "https://example.com/a", LinkFirst: true, Separator: " | "}
+	if got, want := n.message(), "https://example.com/a | Title"; got != want {
+		t.Errorf("message() = %q, want %q", got, want)
+	}
+	n.SingleLine = true
+	n.Separator = ""
+	if got, want := n.message(), "https://example.com/a — Title"; got != want {
+		t.Errorf("message() = %q, want %q", got, want)
+	}
+}
+
+func TestBackfillFollowsNextPages(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+
+	ntfy, messages := ntfyServer(t)
+	entry := func(title string, published time.Time) string {
+		return fmt.Sprintf("<entry><title>%s</title><id>%s</id><published>%s</published></entry>", title, title, published.Format(time.RFC3339))
+	}
+	pages := map[string]string{
+		"/feed":  `<link rel="next" href="/page2"/>` + entry("recent", now.Add(-time.Hour)),
+		"/page2": `<link rel="next" href="/page3"/>` + entry("older", now.Add(-24*time.Hour)),
+		"/page3": `<link rel="next" href="/feed"/>` + entry("oldest", now.Add(-48*time.Hour)),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<feed xmlns="http://www.w3.org/2005/Atom"><title>T</title>%s</feed>`, pages[r.URL.Path])
+	}))
+	t.Cleanup(srv.Close)
+
+	feeds := []Feed{{URL: srv.URL + "/feed", NtfyTopic: ntfy.URL + "/test", LastUpdate: now}}
+	replayFeeds(feeds, 0, 1, srv.Client())
+	if got, want := messages(), "recent older"; strings.Join(got, " ") != want {
+		t.Errorf("notified %q, want %q", got, want)
+	}
+}
+
+func TestFormatSkipsDetection(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+	ntfy, messages := ntfyServer(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<feed xmlns="http://www.w3.org/2005/Atom"><entry><title>new</title><id>1</id><published>%s</published></entry></feed>`,
+			now.Add(-time.Minute).Format(time.RFC3339))
+	}))
+	t.Cleanup(srv.Close)
+
+	feed := &Feed{URL: srv.URL, NtfyTopic: ntfy.URL + "/test", LastUpdate: now.Add(-time.Hour)}
+	if result := processFeed(feed, srv.Client()); !errors.Is(result.Err, ErrParse) {
+		t.Fatalf("auto format: error = %v, want a parse error for the text/html response", result.Err)
+	}
+	feed.Format = "atom"
+	if result := processFeed(feed, srv.Client()); result.Err != nil || result.Notified != 1 {
+		t.Fatalf("format atom: result = %+v, want 1 notified", result)
+	}
+	if got := messages(); len(got) != 1 || got[0] != "new" {
+		t.Errorf("got notifications %q, want [new]", got)
+	}
+}
+
+func TestRecordResultTracksFailures(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+	feed := &Feed{URL: "https://a.example/feed"}
+
+	recordResult(feed, FeedResult{Err: ErrFetch})
+	recordResult(feed, FeedResult{Err: ErrFetch})
+	if feed.failures != 2 || !feed.lastSuccess.IsZero() {
+		t.Fatalf("after two failures: failures = %d, last success %v", feed.failures, feed.lastSuccess)
+	}
+	recordResult(feed, FeedResult{Notified: 3})
+	if feed.failures != 0 || feed.notified != 3 || !feed.lastSuccess.Equal(now) {
+		t.Errorf("after a success: failures = %d, notified = %d, last success %v", feed.failures, feed.notified, feed.lastSuccess)
+	}
+}
+
+func TestThrottleSendsDigest(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fake := useFakeClock(t, now)
+	ntfy, messages := ntfyServer(t)
+
+	items := rssItem("a", now.Add(-3*time.Minute)) + rssItem("b", now.Add(-2*time.Minute)) + rssItem("c", now.Add(-time.Minute))
+	feedSrv, _ := rssServer(t, items)
+	feed := &Feed{URL: feedSrv.URL, NtfyTopic: ntfy.URL + "/test", Throttle: 15 * time.Minute, LastUpdate: now.Add(-time.Hour)}
+
+	if result := processFeed(feed, feedSrv.Client()); result.Err != nil || result.Notified != 1 {
+		t.Fatalf("first check: result = %+v, want 1 notified", result)
+	}
+	fake.Advance(10 * time.Minute)
+	processFeed(feed, feedSrv.Client())
+	if got := messages(); len(got) != 1 {
+		t.Fatalf("within the window: got %d notifications, want 1", len(got))
+	}
+
+	fake.Advance(10 * time.Minute)
+	if result := processFeed(feed, feedSrv.Client()); result.Notified != 1 {
+		t.Fatalf("after the window: result = %+v, want the digest notified", result)
+	}
+	got := messages()
+	want := "2 new items\n\n- [b](https://example.com/b)\n- [c](https://example.com/c)"
+	if len(got) != 2 || got[1] != want {
+		t.Errorf("got notifications %q, want the digest %q", got, want)
+	}
+}
+
+func TestThrottleDigestPerTopic(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fake := useFakeClock(t, now)
+	var mu sync.Mutex
+	var sent []string
+	ntfy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		sent = append(sent, r.URL.Path+": "+string(body))
+		mu.Unlock()
+	}))
+	t.Cleanup(ntfy.Close)
+
+	path := filepath.Join(t.TempDir(), "feed.xml")
+	var feed *Feed
+	item := func(guid, title, category string, published time.Time) string {
+		return fmt.Sprintf("<item><title>%s</title><guid>%s</guid><category>%s</category><pubDate>%s</pubDate></item>",
+			title, guid, category, published.Format(time.RFC1123Z))
+	}
+	check := func(items ...string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte("<rss><channel><title>T</title>"+strings.Join(items, "")+"</channel></rss>"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if result := processFeed(feed, http.DefaultClient); result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+	feed = &Feed{
+		URL:                   "file://" + path,
+		NtfyTopic:             ntfy.URL + "/main",
+		CategoryTopics:        map[string]string{"other": ntfy.URL + "/other"},
+		Throttle:              15 * time.Minute,
+		NotifyOnContentChange: true,
+		LastUpdate:            now.Add(-time.Hour),
+	}
+
+	check(item("a", "a", "", now.Add(-time.Minute)))
+	fake.Advance(5 * time.Minute)
+	check(item("a", "a v2", "", now.Add(-time.Minute)), item("b", "b", "other", now.Add(time.Minute)), item("c", "c", "", now.Add(2*time.Minute)))
+	fake.Advance(15 * time.Minute)
+	check(item("a", "a v2", "", now.Add(-time.Minute)), item("b", "b", "other", now.Add(time.Minute)), item("c", "c", "", now.Add(2*time.Minute)))
+
+	want := []string{"/main: a", "/main: 2 new items\n\n- Updated: a v2\n- c", "/other: 1 new items\n\n- b"}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent %q, want %q", sent, want)
+	}
+}
+
+func TestCloudflareChallengeIsReported(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "cloudflare")
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "<html><head><title>Just a moment...</title></head></html>")
+	}))
+	t.Cleanup(srv.Close)
+
+	result := processFeed(&Feed{URL: srv.URL, NtfyTopic: "http://ntfy.invalid/test"}, srv.Client())
+	if !errors.Is(result.Err, errCloudflareChallenge) || result.Category() != "fetch" {
+		t.Errorf("error = %v (%s), want a Cloudflare challenge fetch error", result.Err, result.Category())
+	}
+}
+
+func TestFutureDates(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, mode := range []string{"keep", "clamp", "skip"} {
+		t.Run(mode, func(t *testing.T) {
+			fake := useFakeClock(t, now)
+			ntfy, messages := ntfyServer(t)
+			items := rssItem("skewed", now.Add(2*time.Hour))
+			feedSrv, _ := rssServer(t, items)
+			feed := &Feed{URL: feedSrv.URL, NtfyTopic: ntfy.URL + "/test", FutureDates: mode, LastUpdate: now.Add(-time.Hour)}
+			processFeed(feed, feedSrv.Client())
+
+			// A correctly dated item published a little later.
+			fake.Advance(10 * time.Minute)
+			items += rssItem("later", now.Add(5*time.Minute))
+			feedSrv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, "<rss><channel><title>Test</title>%s</channel></rss>", items)
+			})
+			processFeed(feed, feedSrv.Client())
+
+			var titles []string
+			for _, m := range messages() {
+				titles = append(titles, strings.SplitN(m, "\n", 2)[0])
+			}
+			want := map[string]string{"keep": "skewed", "clamp": "skewed later", "skip": "later"}[mode]
+			if got := strings.Join(titles, " "); got != want {
+				t.Errorf("notified %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRedeliveryWaitsOutOutages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	topic := srv.URL + "/outage"
+	srv.Close()
+
+	q := &deadLetterQueue{}
+	q.add(deadLetter{Notification: Notification{Topic: topic, Title: "first"}, Attempts: 1})
+	q.add(deadLetter{Notification: Notification{Topic: topic, Title: "second"}, Attempts: 1})
+	for i := 0; i < notifyRetry.Redeliveries+2; i++ {
+		q.redeliver(nil)
+	}
+	if len(q.items) != 2 || q.items[0].Notification.Title != "first" || q.items[0].Attempts != 1 {
+		t.Errorf("queue after an outage = %+v, want both kept in order without using up attempts", q.items)
+	}
+}
+
+func TestNotifyOnContentChange(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+	ntfy, messages := ntfyServer(t)
+
+	description := "$20"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<rss><channel><title>Deals</title><item><title>Deal</title><guid>1</guid><link>https://example.com/deal</link><pubDate>%s</pubDate><description>%s</description></item></channel></rss>",
+			now.Add(-time.Hour).Format(time.RFC1123Z), description)
+	}))
+	t.Cleanup(srv.Close)
+	feed := &Feed{URL: srv.URL, NtfyTopic: ntfy.URL + "/test", NotifyOnContentChange: true, LastUpdate: now}
+
+	processFeed(feed, srv.Client())
+	processFeed(feed, srv.Client())
+	if got := messages(); len(got) != 0 {
+		t.Fatalf("got notifications %q for an unchanged item", got)
+	}
+	description = "$15"
+	processFeed(feed, srv.Client())
+	processFeed(feed, srv.Client())
+	want := "Updated: Deal\n\nhttps://example.com/deal"
+	if got := messages(); len(got) != 1 || got[0] != want {
+		t.Errorf("got notifications %q, want [%q]", got, want)
+	}
+}
+
+func TestRunLimits(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fake := useFakeClock(t, start)
+	const tick = 10 * time.Minute
+	// run follows the main loop, each check taking a minute, and returns
+	// when each check started.
+	run := func(limits runLimits) []time.Time {
+		t.Helper()
+		var checks []time.Time
+		for cycle := 1; cycle <= 100; cycle++ {
+			checks = append(checks, fake.Now())
+			fake.Advance(time.Minute)
+			if limits.stop(cycle, tick) != "" {
+				return checks
+			}
+			fake.Advance(tick)
+		}
+		t.Fatal("run didn't stop after 100 checks")
+		return nil
+	}
+
+	if checks := run(runLimits{maxCycles: 3, started: fake.Now()}); len(checks) != 3 {
+		t.Errorf("-max-cycles 3 ran %d checks", len(checks))
+	}
+
+	started := fake.Now()
+	checks := run(runLimits{maxRuntime: time.Hour, started: started})
+	if len(checks) != 6 {
+		t.Errorf("-max-runtime 1h ran %d checks, want 6, started at %v", len(checks), checks)
+	}
+	for _, check := range checks {
+		if check.Sub(started) > time.Hour {
+			t.Errorf("check started at %v, past -max-runtime", check.Sub(started))
+		}
+	}
+
+	if stop := (runLimits{started: fake.Now()}).stop(1000, tick); stop != "" {
+		t.Errorf("run without limits stopped: %s", stop)
+	}
+}
+
+func TestStaggerFirstPolls(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fake := useFakeClock(t, now)
+	polled := now.Add(-time.Minute)
+	feeds := []Feed{
+		{URL: "a", interval: time.Hour},
+		{URL: "b", interval: time.Hour},
+		{URL: "c", interval: time.Hour, lastPoll: polled},
+	}
+	staggerFirstPolls(feeds)
+	if !feeds[2].lastPoll.Equal(polled) {
+		t.Errorf("lastPoll of polled feed changed to %v", feeds[2].lastPoll)
+	}
+	for _, feed := range feeds[:2] {
+		due := feed.lastPoll.Add(feed.interval)
+		if due.Before(now) || !due.Before(now.Add(time.Hour)) {
+			t.Errorf("feed %s due at %v, want within an hour of %v", feed.URL, due, now)
+		}
+	}
+
+	sleep := nextSleep(feeds, time.Hour)
+	if sleep <= 0 || sleep > time.Hour {
+		t.Fatalf("nextSleep = %v", sleep)
+	}
+	fake.Sleep(sleep)
+	due := 0
+	for _, feed := range feeds {
+		if !clock.Now().Before(feed.lastPoll.Add(feed.interval)) {
+			due++
+		}
+	}
+	if due == 0 {
+		t.Errorf("no feed due after sleeping %v", sleep)
+	}
+}
+
+func TestFileFeed(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+	ntfy, messages := ntfyServer(t)
+	path := filepath.Join(t.TempDir(), "feed.xml")
+	rss := "<rss><channel><title>Test</title>" + rssItem("new", now.Add(-time.Minute)) + "</channel></rss>"
+	if err := os.WriteFile(path, []byte(rss), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	feed := &Feed{URL: "file://" + path, NtfyTopic: ntfy.URL + "/test", LastUpdate: now.Add(-time.Hour)}
+	if result := processFeed(feed, http.DefaultClient); result.Err != nil || result.Notified != 1 {
+		t.Fatalf("result = %+v, want 1 notified", result)
+	}
+	if got := messages(); len(got) != 1 || !strings.HasPrefix(got[0], "new") {
+		t.Errorf("got notifications %q, want one for new", got)
+	}
+
+	feed = &Feed{URL: "file://" + path + ".missing", NtfyTopic: ntfy.URL + "/test"}
+	if result := processFeed(feed, http.DefaultClient); !errors.Is(result.Err, ErrFetch) {
+		t.Errorf("missing file: error = %v, want a fetch error", result.Err)
+	}
+}
+
+func TestLoginFeed(t *testing.T) {
+	session, logins := "one", 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			fmt.Fprint(w, "<html>login page</html>")
+			return
+		}
+		if r.PostFormValue("user") != "alice" || r.PostFormValue("password") != "secret" {
+			http.Error(w, "bad login", http.StatusForbidden)
+			return
+		}
+		logins++
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: session, Path: "/"})
+	})
+	mux.HandleFunc("/feed", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != session {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "<rss><channel><title>Private</title></channel></rss>")
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	feed := &Feed{URL: srv.URL + "/feed", Login: &Login{
+		URL:    srv.URL + "/login",
+		Fields: map[string]string{"user": "alice", "password": "secret"},
+	}}
+	logger := log.WithField("feed", feed.URL)
+	for _, expire := range []bool{false, false, true} {
+		if expire {
+			session = "two"
+		}
+		body, err := fetchFeedBody(context.Background(), feed, http.DefaultClient, logger)
+		if err != nil || !strings.Contains(string(body), "Private") {
+			t.Fatalf("fetchFeedBody = %q, %v; want the feed", body, err)
+		}
+	}
+	if logins != 2 {
+		t.Errorf("logged in %d times, want once at first and once when the session expired", logins)
+	}
+
+	feed.Login.Fields["password"] = "wrong"
+	feed.jar = nil
+	if _, err := fetchFeedBody(context.Background(), feed, http.DefaultClient, logger); !errors.Is(err, ErrFetch) {
+		t.Errorf("failed login: error = %v, want a fetch error", err)
+	}
+}
+
+func TestAlertOnEmpty(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+	recorder := &recordingNotifier{}
+	notifier = recorder
+	errorTopic = "https://ntfy.example/errors"
+	t.Cleanup(func() {
+		notifier = NtfyNotifier{}
+		errorTopic = ""
+	})
+
+	path := filepath.Join(t.TempDir(), "feed.xml")
+	feed := &Feed{URL: "file://" + path, NtfyTopic: "https://ntfy.example/feed", AlertOnEmpty: true, LastUpdate: now}
+	for _, items := range []string{"", rssItem("old", now.Add(-time.Hour)), "", ""} {
+		rss := "<rss><channel><title>Test</title>" + items + "</channel></rss>"
+		if err := os.WriteFile(path, []byte(rss), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if result := processFeed(feed, http.DefaultClient); result.Err != nil {
+			t.Fatal(result.Err)
+		}
+	}
+
+	if len(recorder.sent) != 1 || recorder.sent[0].Topic != errorTopic {
+		t.Fatalf("sent %+v, want one alert to the error topic", recorder.sent)
+	}
+	if !strings.Contains(recorder.sent[0].Body, "had 1 at the last check") {
+		t.Errorf("alert body %q doesn't give the previous item count", recorder.sent[0].Body)
+	}
+
+	if _, err := loadConfig(writeConfig(t, "feeds:\n  - url: https://a.example/feed\n    ntfy_topic: https://ntfy.example/a\n    alert_on_empty: true\n")); err == nil {
+		t.Error("loadConfig accepted alert_on_empty without error_topic")
+	}
+}
+
+func TestQuietRecovery(t *testing.T) {
+	for _, quiet := range []bool{false, true} {
+		start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		fake := useFakeClock(t, start)
+		recorder := &recordingNotifier{}
+		notifier = recorder
+		t.Cleanup(func() { notifier = NtfyNotifier{} })
+
+		path := filepath.Join(t.TempDir(), "feed.xml")
+		feed := &Feed{URL: "file://" + path, NtfyTopic: "https://ntfy.example/t", QuietRecovery: quiet, LastUpdate: start, interval: 10 * time.Minute}
+		check := func(items ...string) {
+			t.Helper()
+			if items == nil {
+				os.Remove(path)
+			} else if err := os.WriteFile(path, []byte("<rss><channel><title>T</title>"+strings.Join(items, "")+"</channel></rss>"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			recordResult(feed, processFeed(feed, http.DefaultClient))
+			fake.Advance(10 * time.Minute)
+		}
+
+		check(rssItem("before", start.Add(-time.Minute)))
+		check()
+		check()
+		missed := []string{rssItem("missed1", start.Add(15*time.Minute)), rssItem("missed2", start.Add(25*time.Minute))}
+		check(missed...)
+		check(append(missed, rssItem("after", start.Add(35*time.Minute)))...)
+
+		var titles []string
+		for _, n := range recorder.sent {
+			titles = append(titles, n.Title)
+		}
+		want := []string{"missed1", "missed2", "after"}
+		if quiet {
+			want = []string{"after"}
+		}
+		if !reflect.DeepEqual(titles, want) {
+			t.Errorf("quiet_recovery %v: notified %q, want %q", quiet, titles, want)
+		}
+	}
+}
+
+func TestImportance(t *testing.T) {
+	config, err := loadConfig(writeConfig(t, `feeds:
+  - url: https://a.example/feed
+    ntfy_topic: https://ntfy.example/t
+    importance: high
+  - url: https://b.example/feed
+    ntfy_topic: https://ntfy.example/t
+    importance: low
+    priority: 5
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.Feeds[0].Priority; got != 4 {
+		t.Errorf("importance high: priority = %d, want 4", got)
+	}
+	if got := config.Feeds[1].Priority; got != 5 {
+		t.Errorf("importance low with priority 5: priority = %d, want 5", got)
+	}
+
+	_, err = loadConfig(writeConfig(t, "feeds:\n  - url: https://a.example/feed\n    ntfy_topic: https://ntfy.example/t\n    importance: loud\n"))
+	if err == nil || !strings.Contains(err.Error(), "importance") {
+		t.Errorf("unknown importance: error = %v", err)
+	}
+}
+
+func TestItemMatches(t *testing.T) {
+	raw := `<title>Patch</title><category>Security</category><category>News</category>` +
+		`<media:content url="https://example.com/a.mp4" medium="video"/><description>Fixes CVE-2024-1</description>`
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"category = 'Security'", true},
+		{`category = "Sports"`, false},
+		{"category != 'News'", true},
+		{"contains(description, 'CVE-')", true},
+		{"contains(title, 'CVE-')", false},
+		{"media:content/@medium = 'video'", true},
+		{"dc:creator", false},
+	}
+	for _, tt := range tests {
+		if got := itemMatches(tt.expr, raw); got != tt.want {
+			t.Errorf("itemMatches(%q) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+	for _, expr := range []string{"category = Security", "a//b", "@x/y"} {
+		if _, err := parseMatch(expr); err == nil {
+			t.Errorf("parseMatch(%q) succeeded, want an error", expr)
+		}
+	}
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+	ntfy, messages := ntfyServer(t)
+	srv, _ := rssServer(t, rssItem("plain", now.Add(-2*time.Minute))+
+		strings.Replace(rssItem("tagged", now.Add(-time.Minute)), "<title>", "<category>Security</category><title>", 1))
+	feed := &Feed{URL: srv.URL, NtfyTopic: ntfy.URL + "/test", LastUpdate: now.Add(-time.Hour), Match: "category = 'Security'"}
+	if result := processFeed(feed, srv.Client()); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if got := messages(); len(got) != 1 || !strings.HasPrefix(got[0], "tagged") {
+		t.Errorf("got notifications %q, want one for tagged", got)
+	}
+}
+
+func TestVerifyTopics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/public/auth":
+		case r.Header.Get("Authorization") == "Bearer tk_good":
+		case r.Header.Get("Authorization") != "":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	feeds := []Feed{
+		{URL: "a", NtfyTopic: srv.URL + "/public"},
+		{URL: "b", NtfyTopic: srv.URL + "/private", NtfyToken: "tk_good"},
+		{URL: "c", NtfyTopic: srv.URL + "/private", NtfyToken: "tk_good"},
+	}
+	var out strings.Builder
+	if !verifyTopics(&out, feeds, srv.Client()) {
+		t.Errorf("verifyTopics failed:\n%s", out.String())
+	}
+	if got := strings.Count(out.String(), "\n"); got != 2 {
+		t.Errorf("got %d lines, want one per topic:\n%s", got, out.String())
+	}
+
+	out.Reset()
+	feeds = append(feeds, Feed{URL: "d", NtfyTopic: srv.URL + "/other", NtfyToken: "tk_expired"})
+	if verifyTopics(&out, feeds, srv.Client()) || !strings.Contains(out.String(), "/other: token rejected (401)") {
+		t.Errorf("expired token not reported:\n%s", out.String())
+	}
+}
+
+func TestProcessTimeoutAbandonsStuckFeed(t *testing.T) {
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(stuck.Close)
+	t.Cleanup(func() { close(release) })
+	ntfy, _ := ntfyServer(t)
+	ok, _ := rssServer(t, "")
+
+	feeds := []Feed{
+		{URL: stuck.URL, NtfyTopic: ntfy.URL + "/test", ProcessTimeout: 50 * time.Millisecond},
+		{URL: ok.URL, NtfyTopic: ntfy.URL + "/test"},
+	}
+	results := processFeedsAsync(feeds, http.DefaultClient)
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, result := range results {
+		if result.URL == stuck.URL && (result.Err == nil || !strings.Contains(result.Err.Error(), "timed out")) {
+			t.Errorf("stuck feed: error = %v, want a timeout", result.Err)
+		}
+	}
+
+	// The abandoned check's request is cancelled, so it winds down without
+	// the server ever answering.
+	waitFor(t, func() bool {
+		statsMu.Lock()
+		defer statsMu.Unlock()
+		return !feeds[0].processing
+	})
+}
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within a second")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// blockingNotifier blocks every send until release is closed, whatever
+// the context.
+type blockingNotifier struct {
+	release chan struct{}
+}
+
+func (b blockingNotifier) Send(ctx context.Context, n Notification) error {
+	<-b.release
+	return nil
+}
+
+func TestAbandonedCheckLeavesFeedUnchanged(t *testing.T) {
+	release := make(chan struct{})
+	notifier = blockingNotifier{release}
+	t.Cleanup(func() { notifier = NtfyNotifier{} })
+
+	lastUpdate := time.Now().Add(-time.Hour)
+	srv, _ := rssServer(t, rssItem("New", time.Now()))
+	feeds := []Feed{{URL: srv.URL, NtfyTopic: "https://ntfy.example/test", LastUpdate: lastUpdate, ProcessTimeout: 50 * time.Millisecond}}
+	results := processFeedsAsync(feeds, srv.Client())
+	if len(results) != 1 || results[0].Err == nil {
+		t.Fatalf("results = %+v, want a timeout", results)
+	}
+	if results := processFeedsAsync(feeds, srv.Client()); len(results) != 0 {
+		t.Errorf("feed checked again while its abandoned check runs: %+v", results)
+	}
+
+	close(release)
+	waitFor(t, func() bool {
+		statsMu.Lock()
+		defer statsMu.Unlock()
+		return !feeds[0].processing
+	})
+	if !feeds[0].LastUpdate.Equal(lastUpdate) {
+		t.Errorf("LastUpdate = %v after an abandoned check, want %v", feeds[0].LastUpdate, lastUpdate)
+	}
+}
+
+func TestRulesOverrideNotification(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+	recorder := &recordingNotifier{}
+	notifier = recorder
+	t.Cleanup(func() { notifier = NtfyNotifier{} })
+
+	feedSrv, _ := rssServer(t, rssItem("Weekly", now.Add(-2*time.Minute))+rssItem("Critical-CVE", now.Add(-time.Minute)))
+	feed := &Feed{
+		URL:        feedSrv.URL,
+		NtfyTopic:  "https://ntfy.example/test",
+		Priority:   2,
+		LastUpdate: now.Add(-time.Hour),
+		Rules: []Rule{
+			{Keywords: []string{"sports"}, Priority: 1},
+			{Keywords: []string{"cve"}, MessageTemplate: "SECURITY: {{.Title}}", Priority: 5, Tags: "warning"},
+		},
+	}
+	if result := processFeed(feed, feedSrv.Client()); result.Err != nil || result.Notified != 2 {
+		t.Fatalf("result = %+v, want 2 notified", result)
+	}
+	if n := recorder.sent[0]; n.Priority != 2 || n.Tags != "" || n.message() != "Weekly\n\nhttps://example.com/Weekly" {
+		t.Errorf("unmatched item sent as %+v", n)
+	}
+	if n := recorder.sent[1]; n.Priority != 5 || n.Tags != "warning" || n.message() != "SECURITY: Critical-CVE" {
+		t.Errorf("matched item sent as %+v", n)
+	}
+}
+
+func TestExampleConfigLoads(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "feeds.yaml")
+	if err := writeExampleConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig of the example config: %v", err)
+	}
+	if len(config.Feeds) == 0 || config.Feeds[0].NtfyTopic == "" {
+		t.Errorf("example feeds = %+v, want feeds with a topic", config.Feeds)
+	}
+	if err := writeExampleConfig(path); err == nil {
+		t.Error("writeExampleConfig overwrote an existing file")
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	// 2024-01-01 is a Monday.
+	at := func(day, hour, minute int) time.Time { return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC) }
+	tests := []struct {
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{"* 9-17 * * 1-5", at(1, 9, 30), true},
+		{"* 9-17 * * 1-5", at(1, 18, 0), false},
+		{"* 9-17 * * 1-5", at(7, 12, 0), false},
+		{"*/15 * * * *", at(1, 0, 45), true},
+		{"*/15 * * * *", at(1, 0, 50), false},
+		{"* * * * 7", at(7, 12, 0), true},
+		{"* * 15 * 1", at(8, 12, 0), true},
+		{"* * 15 * 1", at(9, 12, 0), false},
+		{"0,30 8 1 1 *", at(1, 8, 30), true},
+	}
+	for _, tt := range tests {
+		schedule, err := parseSchedule(tt.expr)
+		if err != nil {
+			t.Fatalf("parseSchedule(%q): %v", tt.expr, err)
+		}
+		if got := schedule.matches(tt.t); got != tt.want {
+			t.Errorf("%q matches %v = %v, want %v", tt.expr, tt.t, got, tt.want)
+		}
+	}
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 17-9 * * *", "*/0 * * * *", "* * * JAN *"} {
+		if _, err := parseSchedule(expr); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestShowSource(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+	recorder := &recordingNotifier{}
+	notifier = recorder
+	t.Cleanup(func() { notifier = NtfyNotifier{} })
+
+	item := strings.Replace(rssItem("post", now.Add(-time.Minute)), "<title>", `<source url="https://blog.example/rss">Alice's Blog</source><title>`, 1)
+	feedSrv, _ := rssServer(t, item+rssItem("plain", now.Add(-2*time.Minute)))
+	feed := &Feed{URL: feedSrv.URL, NtfyTopic: "https://ntfy.example/test", LastUpdate: now.Add(-time.Hour), ShowSource: true}
+	if result := processFeed(feed, feedSrv.Client()); result.Err != nil || result.Notified != 2 {
+		t.Fatalf("result = %+v, want 2 notified", result)
+	}
+	var titles []string
+	for _, n := range recorder.sent {
+		titles = append(titles, n.Title)
+	}
+	sort.Strings(titles)
+	if want := []string{"Alice's Blog: post", "plain"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("titles = %q, want %q", titles, want)
+	}
+}
+
+func TestSplitter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	rssDoc := func(title string, published time.Time) string {
+		return `<?xml version="1.0"?>` + "\n<rss><channel><title>T</title>" + rssItem(title, published) + "</channel></rss>\n"
+	}
+	jsonDoc := func(title string, published time.Time) string {
+		return fmt.Sprintf(`{"version": "https://jsonfeed.org/version/1.1", "items": [{"id": %q, "title": %q, "date_published": %q}]}`, title, title, published.Format(time.RFC3339))
+	}
+	tests := []struct {
+		splitter, body string
+	}{
+		{"xml", rssDoc("a", now.Add(-2*time.Minute)) + rssDoc("b", now.Add(-time.Minute))},
+		{"json", jsonDoc("a", now.Add(-2*time.Minute)) + "\n" + jsonDoc("b", now.Add(-time.Minute)) + "\n"},
+		{"json", "[" + jsonDoc("a", now.Add(-2*time.Minute)) + "," + jsonDoc("b", now.Add(-time.Minute)) + "]"},
+	}
+	for _, tt := range tests {
+		useFakeClock(t, now)
+		ntfy, messages := ntfyServer(t)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, tt.body)
+		}))
+		feed := &Feed{URL: srv.URL, NtfyTopic: ntfy.URL + "/test", LastUpdate: now.Add(-time.Hour), Splitter: tt.splitter}
+		result := processFeed(feed, srv.Client())
+		srv.Close()
+		if result.Err != nil || result.Notified != 2 {
+			t.Errorf("%s splitter: result = %+v, want 2 notified", tt.splitter, result)
+		} else if got := messages(); !strings.HasPrefix(got[0], "a") || !strings.HasPrefix(got[1], "b") {
+			t.Errorf("%s splitter: got notifications %q", tt.splitter, got)
+		}
+	}
+
+	mixed := rssDoc("a", now) + `<feed xmlns="http://www.w3.org/2005/Atom"><title>T</title></feed>`
+	if _, _, _, err := parseSplitFeed(&Feed{Splitter: "xml"}, []byte(mixed)); err == nil {
+		t.Error("parseSplitFeed of RSS and Atom documents succeeded, want an error")
+	}
+}
+
+func TestPreviewHandler(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fake := useFakeClock(t, now)
+	ntfy, messages := ntfyServer(t)
+	// Previews neither wait for the rate limit nor check the breakers.
+	notifyLimiter = newTokenBucket(RateLimitConfig{Notifications: 1, Period: time.Hour, Burst: 1})
+	notifyLimiter.wait(log.NewEntry(log.StandardLogger()))
+	t.Cleanup(func() { notifyLimiter = nil })
+	savedBreaker := breakerConfig
+	breakerConfig = CircuitBreakerConfig{Failures: 1, Cooldown: time.Hour}
+	t.Cleanup(func() { breakerConfig = savedBreaker })
+	cb, _ := breakerFor(ntfy.URL + "/test")
+	cb.record(false, log.NewEntry(log.StandardLogger()))
+	t.Cleanup(func() { cb.record(true, log.NewEntry(log.StandardLogger())) })
+	failures := fmt.Sprint(sendFailures.lines())
+	feedSrv, _ := rssServer(t, rssItem("old", now.Add(-2*time.Hour))+rssItem("new", now.Add(-time.Minute)))
+	feeds := []Feed{{URL: feedSrv.URL, NtfyTopic: ntfy.URL + "/test", NtfyToken: "tk_secret", Priority: 4, LastUpdate: now.Add(-time.Hour)}}
+	preview := httptest.NewServer(previewHandler(feeds, feedSrv.Client()))
+	t.Cleanup(preview.Close)
+
+	get := func(query string) string {
+		t.Helper()
+		resp, err := http.Get(preview.URL + "/?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if index := get(""); !strings.Contains(index, url.QueryEscape(feedSrv.URL)) {
+		t.Errorf("index doesn't link the feed:\n%s", index)
+	}
+	page := get("feed=" + url.QueryEscape(feedSrv.URL))
+	for _, want := range []string{"1 notifications", "X-Priority: 4", "Authorization: REDACTED", "\nnew\n"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("preview doesn't contain %q:\n%s", want, page)
+		}
+	}
+	if strings.Contains(page, "tk_secret") {
+		t.Error("preview shows the token")
+	}
+	// Previews don't change the feed's state.
+	if page := get("feed=" + url.QueryEscape(feedSrv.URL) + "&since=3h"); !strings.Contains(page, "2 notifications") {
+		t.Errorf("preview since 3h:\n%s", page)
+	}
+	if !feeds[0].LastUpdate.Equal(now.Add(-time.Hour)) {
+		t.Errorf("LastUpdate changed to %v", feeds[0].LastUpdate)
+	}
+	if got := messages(); len(got) != 0 {
+		t.Errorf("previews sent notifications %q", got)
+	}
+	if !fake.Now().Equal(now) {
+		t.Errorf("previews waited for the rate limit until %v", fake.Now())
+	}
+	if got := fmt.Sprint(sendFailures.lines()); got != failures {
+		t.Errorf("previews counted send failures: %s", got)
+	}
+}
+
+func TestFeedTokenStaysOnItsServer(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+	var mu sync.Mutex
+	auth := map[string][]string{}
+	server := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			auth[name] = append(auth[name], r.Header.Get("Authorization"))
+			mu.Unlock()
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	own, other := server("own"), server("other")
+	topicTokens = map[string]string{other.URL: "tk_other"}
+	t.Cleanup(func() { topicTokens = map[string]string{} })
+
+	items := "<item><title>a</title><guid>a</guid><pubDate>" + now.Add(time.Minute).Format(time.RFC1123Z) + "</pubDate></item>" +
+		"<item><title>b</title><guid>b</guid><category>elsewhere</category><pubDate>" + now.Add(2*time.Minute).Format(time.RFC1123Z) + "</pubDate></item>"
+	feedSrv, _ := rssServer(t, items)
+	feed := &Feed{
+		URL:            feedSrv.URL,
+		NtfyTopic:      own.URL + "/t",
+		NtfyToken:      "tk_feed",
+		CategoryTopics: map[string]string{"elsewhere": other.URL + "/t"},
+		LastUpdate:     now,
+	}
+	if result := processFeed(feed, http.DefaultClient); result.Err != nil || result.Notified != 2 {
+		t.Fatalf("result = %+v, want 2 notified", result)
+	}
+
+	want := map[string][]string{"own": {"Bearer tk_feed"}, "other": {"Bearer tk_other"}}
+	if !reflect.DeepEqual(auth, want) {
+		t.Errorf("Authorization headers by server = %q, want %q", auth, want)
+	}
+}
+
+func TestCategoryTopics(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+	recorder := &recordingNotifier{}
+	notifier = recorder
+	t.Cleanup(func() { notifier = NtfyNotifier{} })
+
+	withCategories := func(title string, published time.Time, categories ...string) string {
+		var tags string
+		for _, c := range categories {
+			tags += "<category>" + c + "</category>"
+		}
+		return strings.Replace(rssItem(title, published), "<title>", tags+"<title>", 1)
+	}
+	feedSrv, _ := rssServer(t, withCategories("match", now.Add(-3*time.Minute), "Sports")+
+		withCategories("both", now.Add(-2*time.Minute), "sports", "Tech", "other")+
+		withCategories("none", now.Add(-time.Minute), "other"))
+	feed := &Feed{
+		URL:            feedSrv.URL,
+		NtfyTopic:      "https://ntfy.example/all",
+		CategoryTopics: map[string]string{"sports": "https://ntfy.example/sports", "tech": "https://ntfy.example/tech"},
+		LastUpdate:     now.Add(-time.Hour),
+	}
+	if result := processFeed(feed, feedSrv.Client()); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	var got []string
+	for _, n := range recorder.sent {
+		got = append(got, n.Title+" "+n.Topic)
+	}
+	sort.Strings(got)
+	want := []string{
+		"both https://ntfy.example/sports",
+		"both https://ntfy.example/tech",
+		"match https://ntfy.example/sports",
+		"none https://ntfy.example/all",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %q, want %q", got, want)
+	}
+}
+
+func TestResolveFeedLinks(t *testing.T) {
+	var rss Rss
+	if err := xml.Unmarshal([]byte(`<rss><channel xml:base="/blog/">`+
+		`<item><link>post-1</link></item>`+
+		`<item xml:base="https://other.example/a/"><link>post-2</link></item>`+
+		`<item><link>https://abs.example/x</link></item>`+
+		`</channel></rss>`), &rss); err != nil {
+		t.Fatal(err)
+	}
+	var atom Atom
+	if err := xml.Unmarshal([]byte(`<feed xmlns="http://www.w3.org/2005/Atom" xml:base="https://example.com/news/">`+
+		`<entry><link href="2024/one"/></entry>`+
+		`<entry xml:base="archive/"><link href="two"/></entry>`+
+		`</feed>`), &atom); err != nil {
+		t.Fatal(err)
+	}
+	resolveFeedLinks("https://example.com/feed.xml", &rss, &atom)
+
+	var got []string
+	for _, item := range rss.Channel.Item {
+		got = append(got, item.Link)
+	}
+	for _, entry := range atom.Entries {
+		got = append(got, entry.Link.Href)
+	}
+	want := []string{
+		"https://example.com/blog/post-1",
+		"https://other.example/a/post-2",
+		"https://abs.example/x",
+		"https://example.com/news/2024/one",
+		"https://example.com/news/archive/two",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("links = %q, want %q", got, want)
+	}
+}
+
+func TestDateFields(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+	ntfy, messages := ntfyServer(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<rss xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:atom="http://www.w3.org/2005/Atom"><channel><title>T</title>`+
+			`<item><title>dc</title><dc:date>%s</dc:date><pubDate>%s</pubDate></item>`+
+			`<item><title>updated</title><atom:updated>%s</atom:updated></item>`+
+			`</channel></rss>`,
+			now.Add(-time.Minute).Format(time.RFC3339), now.Add(-48*time.Hour).Format(time.RFC1123Z), now.Add(-2*time.Minute).Format(time.RFC3339))
+	}))
+	t.Cleanup(srv.Close)
+
+	feed := &Feed{URL: srv.URL, NtfyTopic: ntfy.URL + "/test", LastUpdate: now.Add(-time.Hour)}
+	if result := processFeed(feed, srv.Client()); result.Err != nil || result.Notified != 0 {
+		t.Fatalf("pubDate only: result = %+v, want nothing notified", result)
+	}
+	feed = &Feed{URL: srv.URL, NtfyTopic: ntfy.URL + "/test", LastUpdate: now.Add(-time.Hour), DateFields: []string{"dc:date", "updated", "pubDate"}}
+	if result := processFeed(feed, srv.Client()); result.Err != nil || result.Notified != 2 {
+		t.Fatalf("date_fields: result = %+v, want 2 notified", result)
+	}
+	if got := messages(); len(got) != 2 || !strings.HasPrefix(got[0], "updated") || !strings.HasPrefix(got[1], "dc") {
+		t.Errorf("got notifications %q", got)
+	}
+}
+
+// largeFeed is an RSS document of n items with some content each.
+func largeFeed(n int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`<rss><channel><title>Large</title>`)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, `<item><title>Item %d</title><link>https://example.com/%d</link><guid>%d</guid><pubDate>Mon, 01 Jan 2024 12:00:00 +0000</pubDate><description>%s</description></item>`,
+			i, i, i, strings.Repeat("Lorem ipsum dolor sit amet. ", 40))
+	}
+	b.WriteString(`</channel></rss>`)
+	return b.Bytes()
+}
+
+func BenchmarkDecodeLargeFeed(b *testing.B) {
+	feed := largeFeed(5000)
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			body, err := readFeedBody(bytes.NewReader(feed), maxFeedSize)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, _, _, err := parseFeedAs("rss", body); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var rss Rss
+			if err := xml.NewDecoder(bytes.NewReader(feed)).Decode(&rss); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}